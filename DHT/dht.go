@@ -0,0 +1,368 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Alpha is the number of nodes a lookup queries at the same time
+const Alpha = 3
+
+const (
+	// defining how long the record of a provider is kept unless it is announced again
+	defaultProviderTTL = time.Hour
+
+	// defining how many records of providers a node keeps for other nodes
+	defaultMaxProviders = 1 << 16
+)
+
+// ErrNoProviders is returned when a lookup ends without finding a node holding the key
+var ErrNoProviders = errors.New("no providers found")
+
+// Network carries the RPCs of the DHT to other nodes.
+// The receiving node answers them through the Handle methods of its DHT.
+type Network interface {
+	// FindNode asks to for the contacts it knows closest to target
+	FindNode(ctx context.Context, to Contact, target ID) ([]Contact, error)
+
+	// FindValue asks to for the providers of key,
+	// or the contacts it knows closest to key if it knows of none
+	FindValue(ctx context.Context, to Contact, key ID) (providers []Contact, closer []Contact, err error)
+
+	// Store tells to that provider holds key
+	Store(ctx context.Context, to Contact, key ID, provider Contact) error
+}
+
+// DHT locates nodes and the providers of keys in a network where
+// nodes are not all connected to each other, following Kademlia:
+// every lookup asks the closest contacts known so far for closer ones
+// until no closer contact turns up.
+type DHT struct {
+	// ProviderTTL is how long the record of a provider is kept, the keys
+	// this node provides are announced again every half of it by Run.
+	// MaxProviders is how many records of other nodes are kept at most,
+	// no more than K of them for a key.
+	ProviderTTL  time.Duration
+	MaxProviders int
+
+	self    Contact
+	table   *RoutingTable
+	network Network
+
+	// the providers of the keys this node is among the closest to,
+	// records counts them and provided holds the keys this node provides
+	lockProviders sync.Mutex
+	providers     map[ID][]provider
+	records       int
+	provided      map[ID]bool
+}
+
+// provider is the record of a node which announced that it holds a key
+type provider struct {
+	Contact
+	expires time.Time
+}
+
+func New(self Contact, network Network) *DHT {
+	return &DHT{
+		ProviderTTL:  defaultProviderTTL,
+		MaxProviders: defaultMaxProviders,
+		self:         self,
+		table:        NewRoutingTable(self.key()),
+		network:      network,
+		providers:    make(map[ID][]provider),
+		provided:     make(map[ID]bool),
+	}
+}
+
+func (d *DHT) Self() Contact {
+	return d.self
+}
+
+func (d *DHT) Table() *RoutingTable {
+	return d.table
+}
+
+// AddContact records a node this one learned about outside of the DHT,
+// like a peer it connected to
+func (d *DHT) AddContact(c Contact) {
+	d.seen(c)
+}
+
+// seen records a contact the node heard from, unless it has no address to reach it
+func (d *DHT) seen(c Contact) {
+	if len(c.Addr) > 0 {
+		d.table.Update(c)
+	}
+}
+
+// Bootstrap looks up the node itself, which fills the routing table
+// with the nodes close to it and announces it to them
+func (d *DHT) Bootstrap(ctx context.Context) error {
+	_, err := d.Lookup(ctx, d.self.key())
+	return err
+}
+
+// HandleFindNode answers a FindNode RPC from another node
+func (d *DHT) HandleFindNode(from Contact, target ID) []Contact {
+	d.seen(from)
+	return d.table.Closest(target, K)
+}
+
+// HandleFindValue answers a FindValue RPC from another node
+func (d *DHT) HandleFindValue(from Contact, key ID) ([]Contact, []Contact) {
+	d.seen(from)
+	if providers := d.localProviders(key); len(providers) > 0 {
+		return providers, nil
+	}
+	return nil, d.table.Closest(key, K)
+}
+
+// HandleStore answers a Store RPC from another node
+func (d *DHT) HandleStore(from Contact, key ID, provider Contact) {
+	d.seen(from)
+	d.addProvider(key, provider)
+}
+
+// addProvider records provider for key until ProviderTTL passed.
+// A record which does not fit is dropped, the provider announces it again.
+func (d *DHT) addProvider(key ID, c Contact) {
+	d.lockProviders.Lock()
+	defer d.lockProviders.Unlock()
+
+	now := time.Now()
+	expires := now.Add(d.ProviderTTL)
+	providers := d.providers[key]
+	if i := slices.IndexFunc(providers, func(p provider) bool { return p.ID == c.ID }); i >= 0 {
+		providers[i] = provider{Contact: c, expires: expires}
+		return
+	}
+
+	if d.records >= d.MaxProviders {
+		d.expire(now)
+	}
+	providers = d.providers[key]
+	if d.records >= d.MaxProviders || len(providers) >= K {
+		return
+	}
+	d.providers[key] = append(providers, provider{Contact: c, expires: expires})
+	d.records++
+}
+
+// expire drops the records of providers which expired, caller holds lockProviders
+func (d *DHT) expire(now time.Time) {
+	for key, providers := range d.providers {
+		kept := slices.DeleteFunc(providers, func(p provider) bool { return now.After(p.expires) })
+		d.records -= len(providers) - len(kept)
+		if len(kept) == 0 {
+			delete(d.providers, key)
+		} else {
+			d.providers[key] = kept
+		}
+	}
+}
+
+// localProviders returns the providers of key this node knows of, itself included
+func (d *DHT) localProviders(key ID) []Contact {
+	d.lockProviders.Lock()
+	defer d.lockProviders.Unlock()
+
+	var contacts []Contact
+	if d.provided[key] {
+		contacts = append(contacts, d.self)
+	}
+
+	now := time.Now()
+	for _, p := range d.providers[key] {
+		if !now.After(p.expires) && p.ID != d.self.ID {
+			contacts = append(contacts, p.Contact)
+		}
+	}
+	return contacts
+}
+
+// Lookup returns up to K nodes closest to target which answered
+func (d *DHT) Lookup(ctx context.Context, target ID) ([]Contact, error) {
+	closest, _, err := d.lookup(ctx, target, false)
+	return closest, err
+}
+
+// FindProviders returns the nodes which announced that they hold key
+func (d *DHT) FindProviders(ctx context.Context, key ID) ([]Contact, error) {
+	if providers := d.localProviders(key); len(providers) > 0 {
+		return providers, nil
+	}
+
+	_, providers, err := d.lookup(ctx, key, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(providers) == 0 {
+		return nil, ErrNoProviders
+	}
+	return providers, nil
+}
+
+// Provide announces this node as a provider of key
+// to the K nodes closest to key and to itself
+func (d *DHT) Provide(ctx context.Context, key ID) error {
+	d.lockProviders.Lock()
+	d.provided[key] = true
+	d.lockProviders.Unlock()
+
+	return d.announce(ctx, key)
+}
+
+// Unprovide stops announcing this node as a provider of key.
+// The nodes it was announced to forget it once its record expired.
+func (d *DHT) Unprovide(key ID) {
+	d.lockProviders.Lock()
+	defer d.lockProviders.Unlock()
+
+	delete(d.provided, key)
+}
+
+// Run announces the keys this node provides again every half of ProviderTTL,
+// before their records expire, until the ctx is done
+func (d *DHT) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.ProviderTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.republish(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// republish drops the expired records and announces every key this node provides
+func (d *DHT) republish(ctx context.Context) {
+	d.lockProviders.Lock()
+	d.expire(time.Now())
+	keys := make([]ID, 0, len(d.provided))
+	for key := range d.provided {
+		keys = append(keys, key)
+	}
+	d.lockProviders.Unlock()
+
+	// a key which could not be announced is tried again on the next run
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		d.announce(ctx, key)
+	}
+}
+
+// announce tells the K nodes closest to key that this node provides it
+func (d *DHT) announce(ctx context.Context, key ID) error {
+	closest, err := d.Lookup(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range closest {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			if err := d.network.Store(ctx, c, key, d.self); err != nil {
+				d.table.Remove(c.ID)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// answer is the reply of a node queried by a lookup
+type answer struct {
+	from      Contact
+	contacts  []Contact
+	providers []Contact
+	err       error
+}
+
+// lookup queries Alpha of the closest unqueried contacts at a time,
+// until the K closest contacts known have all been queried.
+// With findValue it stops at the first node which knows providers of target.
+func (d *DHT) lookup(ctx context.Context, target ID, findValue bool) ([]Contact, []Contact, error) {
+	var (
+		shortlist = d.table.Closest(target, K)
+		seen      = map[string]bool{d.self.ID: true}
+		queried   = make(map[string]bool)
+		responded []Contact
+		answers   = make(chan answer, Alpha)
+		inFlight  = 0
+	)
+	for _, c := range shortlist {
+		seen[c.ID] = true
+	}
+
+	for {
+		// the closest contacts which were not queried yet
+		for _, c := range shortlist[:min(K, len(shortlist))] {
+			if inFlight >= Alpha {
+				break
+			}
+			if queried[c.ID] {
+				continue
+			}
+			queried[c.ID] = true
+			inFlight++
+
+			go func(c Contact) {
+				a := answer{from: c}
+				if findValue {
+					a.providers, a.contacts, a.err = d.network.FindValue(ctx, c, target)
+				} else {
+					a.contacts, a.err = d.network.FindNode(ctx, c, target)
+				}
+				answers <- a
+			}(c)
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		var a answer
+		select {
+		case a = <-answers:
+			inFlight--
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+
+		if a.err != nil {
+			d.table.Remove(a.from.ID)
+			shortlist = slices.DeleteFunc(shortlist, func(c Contact) bool { return c.ID == a.from.ID })
+			continue
+		}
+
+		d.table.Update(a.from)
+		responded = append(responded, a.from)
+
+		if len(a.providers) > 0 {
+			return nil, a.providers, nil
+		}
+
+		for _, c := range a.contacts {
+			if !seen[c.ID] {
+				seen[c.ID] = true
+				shortlist = append(shortlist, c)
+			}
+		}
+		sortByDistance(shortlist, target)
+	}
+
+	sortByDistance(responded, target)
+	return responded[:min(K, len(responded))], nil, nil
+}
@@ -0,0 +1,189 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryNetwork delivers the RPCs between DHTs in the same process.
+// Every node is reachable, but only learns about others through the DHT.
+type memoryNetwork struct {
+	nodes map[string]*DHT
+	down  map[string]bool
+}
+
+func (n *memoryNetwork) node(to Contact) (*DHT, error) {
+	d, ok := n.nodes[to.ID]
+	if !ok || n.down[to.ID] {
+		return nil, fmt.Errorf("node %s unreachable", to.ID)
+	}
+	return d, nil
+}
+
+func (n *memoryNetwork) FindNode(ctx context.Context, to Contact, target ID) ([]Contact, error) {
+	d, err := n.node(to)
+	if err != nil {
+		return nil, err
+	}
+	return d.HandleFindNode(n.from(ctx), target), nil
+}
+
+func (n *memoryNetwork) FindValue(ctx context.Context, to Contact, key ID) ([]Contact, []Contact, error) {
+	d, err := n.node(to)
+	if err != nil {
+		return nil, nil, err
+	}
+	providers, closer := d.HandleFindValue(n.from(ctx), key)
+	return providers, closer, nil
+}
+
+func (n *memoryNetwork) Store(ctx context.Context, to Contact, key ID, provider Contact) error {
+	d, err := n.node(to)
+	if err != nil {
+		return err
+	}
+	d.HandleStore(n.from(ctx), key, provider)
+	return nil
+}
+
+type fromKey struct{}
+
+func (n *memoryNetwork) from(ctx context.Context) Contact {
+	return ctx.Value(fromKey{}).(Contact)
+}
+
+// newChain returns nodes which joined the network one after the other,
+// each knowing only the node which joined before it
+func newChain(size int) (*memoryNetwork, []*DHT) {
+	network := &memoryNetwork{
+		nodes: make(map[string]*DHT),
+		down:  make(map[string]bool),
+	}
+
+	nodes := make([]*DHT, size)
+	for i := range nodes {
+		c := Contact{ID: fmt.Sprintf("node%d", i), Addr: fmt.Sprintf(":%d", 4000+i)}
+		nodes[i] = New(c, network)
+		network.nodes[c.ID] = nodes[i]
+
+		if i > 0 {
+			nodes[i].AddContact(nodes[i-1].Self())
+			nodes[i].Bootstrap(contextOf(nodes[i]))
+		}
+	}
+
+	return network, nodes
+}
+
+func contextOf(d *DHT) context.Context {
+	return context.WithValue(context.Background(), fromKey{}, d.Self())
+}
+
+func TestLookup(t *testing.T) {
+	_, nodes := newChain(50)
+
+	target := nodes[42].Self()
+	closest, err := nodes[0].Lookup(contextOf(nodes[0]), target.key())
+	assert.Nil(t, err)
+	assert.NotEmpty(t, closest)
+	assert.Equal(t, target, closest[0])
+
+	// the nodes met on the way are kept
+	assert.Greater(t, nodes[0].Table().Len(), 1)
+}
+
+func TestFindProviders(t *testing.T) {
+	_, nodes := newChain(50)
+
+	key := NewID("somekey")
+	provider := nodes[49]
+	assert.Nil(t, provider.Provide(contextOf(provider), key))
+
+	providers, err := nodes[0].FindProviders(contextOf(nodes[0]), key)
+	assert.Nil(t, err)
+	assert.Equal(t, []Contact{provider.Self()}, providers)
+
+	_, err = nodes[0].FindProviders(contextOf(nodes[0]), NewID("nosuchkey"))
+	assert.True(t, errors.Is(err, ErrNoProviders))
+}
+
+func TestLookupRemovesUnreachable(t *testing.T) {
+	network, nodes := newChain(3)
+	gone := nodes[2].Self()
+	network.down[gone.ID] = true
+
+	closest, err := nodes[0].Lookup(contextOf(nodes[0]), gone.key())
+	assert.Nil(t, err)
+	assert.Equal(t, []Contact{nodes[1].Self()}, closest)
+	assert.NotContains(t, nodes[0].Table().Closest(gone.key(), K), gone)
+}
+
+func TestLookupCancelled(t *testing.T) {
+	_, nodes := newChain(3)
+
+	ctx, cancel := context.WithCancel(contextOf(nodes[0]))
+	cancel()
+
+	// answers may still arrive before the cancellation is noticed
+	_, err := nodes[0].Lookup(ctx, nodes[2].Self().key())
+	if err != nil {
+		assert.True(t, errors.Is(err, context.Canceled))
+	}
+}
+
+func TestProvidersExpire(t *testing.T) {
+	_, nodes := newChain(20)
+	for _, d := range nodes {
+		d.ProviderTTL = 50 * time.Millisecond
+	}
+
+	provider := nodes[19]
+	kept, dropped := NewID("kept"), NewID("dropped")
+	assert.Nil(t, provider.Provide(contextOf(provider), kept))
+	assert.Nil(t, provider.Provide(contextOf(provider), dropped))
+
+	ctx, cancel := context.WithCancel(contextOf(provider))
+	defer cancel()
+	go provider.Run(ctx)
+
+	// a key which is not provided anymore is forgotten, the other one is announced again
+	provider.Unprovide(dropped)
+	time.Sleep(200 * time.Millisecond)
+
+	var records int
+	for _, d := range nodes[:19] {
+		records += len(d.localProviders(kept))
+		assert.Empty(t, d.localProviders(dropped))
+	}
+	assert.Greater(t, records, 0)
+}
+
+func TestMaxProviders(t *testing.T) {
+	_, nodes := newChain(2)
+	d := nodes[0]
+	d.MaxProviders = 2 * K
+	d.ProviderTTL = 50 * time.Millisecond
+
+	key := NewID("popular")
+	for i := 0; i < 2*K; i++ {
+		d.HandleStore(nodes[1].Self(), key, Contact{ID: fmt.Sprintf("provider%d", i)})
+	}
+	assert.Len(t, d.localProviders(key), K)
+
+	for i := 0; i < 2*K; i++ {
+		d.HandleStore(nodes[1].Self(), NewID(fmt.Sprintf("key%d", i)), nodes[1].Self())
+	}
+	assert.Len(t, d.localProviders(NewID(fmt.Sprintf("key%d", K-1))), 1)
+	assert.Empty(t, d.localProviders(NewID(fmt.Sprintf("key%d", K))))
+
+	// records which expired make room for new ones
+	time.Sleep(60 * time.Millisecond)
+	d.HandleStore(nodes[1].Self(), NewID("late"), nodes[1].Self())
+	assert.Len(t, d.localProviders(NewID("late")), 1)
+	assert.Empty(t, d.localProviders(key))
+}
@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/bits"
+)
+
+// IDLength is the size of an ID in bytes
+const IDLength = sha256.Size
+
+// ID is a position in the key space shared by nodes and keys
+type ID [IDLength]byte
+
+// NewID places a node ID or a key in the key space
+func NewID(s string) ID {
+	return sha256.Sum256([]byte(s))
+}
+
+// Distance returns the XOR distance between two IDs
+func (id ID) Distance(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// Less orders IDs as big-endian numbers
+func (id ID) Less(other ID) bool {
+	return bytes.Compare(id[:], other[:]) < 0
+}
+
+// LeadingZeros returns the number of leading zero bits of the ID
+func (id ID) LeadingZeros() int {
+	for i, b := range id {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return IDLength * 8
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Contact is how a node is reached: its node ID and the address it listens on
+type Contact struct {
+	ID   string
+	Addr string
+}
+
+func (c Contact) key() ID {
+	return NewID(c.ID)
+}
@@ -0,0 +1,107 @@
+package dht
+
+import (
+	"slices"
+	"sync"
+)
+
+// K is the size of a bucket and the number of nodes a lookup converges on
+const K = 20
+
+// RoutingTable keeps the contacts of a node in k-buckets.
+// Bucket i holds the contacts whose distance to the node has i leading
+// zero bits, so the node knows many contacts close to itself
+// and a few in every part of the key space further away.
+type RoutingTable struct {
+	self ID
+
+	lock    sync.Mutex
+	buckets [IDLength * 8][]Contact
+}
+
+func NewRoutingTable(self ID) *RoutingTable {
+	return &RoutingTable{self: self}
+}
+
+// bucket returns the index of the bucket of id, -1 for the node itself
+func (rt *RoutingTable) bucket(id ID) int {
+	i := rt.self.Distance(id).LeadingZeros()
+	if i == IDLength*8 {
+		return -1
+	}
+	return i
+}
+
+// Update records that a contact was seen. A known contact moves to the end
+// of its bucket. A new contact is dropped if its bucket is full,
+// as the contacts which stayed around the longest are the most likely to stay.
+func (rt *RoutingTable) Update(c Contact) {
+	i := rt.bucket(c.key())
+	if i < 0 {
+		return
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	bucket := rt.buckets[i]
+	if j := slices.IndexFunc(bucket, func(b Contact) bool { return b.ID == c.ID }); j >= 0 {
+		bucket = slices.Delete(bucket, j, j+1)
+	} else if len(bucket) >= K {
+		return
+	}
+	rt.buckets[i] = append(bucket, c)
+}
+
+// Remove forgets a contact which failed to answer
+func (rt *RoutingTable) Remove(id string) {
+	i := rt.bucket(NewID(id))
+	if i < 0 {
+		return
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	rt.buckets[i] = slices.DeleteFunc(rt.buckets[i], func(c Contact) bool {
+		return c.ID == id
+	})
+}
+
+// Closest returns up to n contacts ordered by their distance to target
+func (rt *RoutingTable) Closest(target ID, n int) []Contact {
+	rt.lock.Lock()
+	var contacts []Contact
+	for _, bucket := range rt.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	rt.lock.Unlock()
+
+	sortByDistance(contacts, target)
+	return contacts[:min(n, len(contacts))]
+}
+
+// Len returns the number of contacts in the table
+func (rt *RoutingTable) Len() int {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+func sortByDistance(contacts []Contact, target ID) {
+	slices.SortFunc(contacts, func(a, b Contact) int {
+		da, db := a.key().Distance(target), b.key().Distance(target)
+		switch {
+		case da.Less(db):
+			return -1
+		case db.Less(da):
+			return 1
+		}
+		return 0
+	})
+}
@@ -0,0 +1,54 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutingTableClosest(t *testing.T) {
+	self := NewID("self")
+	rt := NewRoutingTable(self)
+
+	for i := 0; i < 100; i++ {
+		rt.Update(Contact{ID: fmt.Sprintf("node%d", i)})
+	}
+	rt.Update(Contact{ID: "self"})
+
+	target := NewID("node7")
+	closest := rt.Closest(target, 5)
+	assert.Len(t, closest, 5)
+	assert.Equal(t, "node7", closest[0].ID)
+
+	for i := 1; i < len(closest); i++ {
+		assert.True(t, closest[i-1].key().Distance(target).Less(closest[i].key().Distance(target)))
+	}
+
+	rt.Remove("node7")
+	assert.NotEqual(t, "node7", rt.Closest(target, 1)[0].ID)
+}
+
+func TestRoutingTableFullBucket(t *testing.T) {
+	self := NewID("self")
+	rt := NewRoutingTable(self)
+
+	// half of all IDs fall into the bucket furthest away
+	var far []Contact
+	for i := 0; len(far) <= K; i++ {
+		c := Contact{ID: fmt.Sprintf("node%d", i)}
+		if rt.bucket(c.key()) == 0 {
+			far = append(far, c)
+		}
+	}
+
+	for _, c := range far {
+		rt.Update(c)
+	}
+	assert.Equal(t, K, rt.Len())
+
+	// the contacts seen first are kept over the newest one
+	closest := rt.Closest(far[K].key(), K+1)
+	assert.NotContains(t, closest, far[K])
+	assert.Contains(t, closest, far[0])
+}
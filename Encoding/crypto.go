@@ -1,14 +1,20 @@
 package enc
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/hex"
 	"io"
 )
 
+// Overhead is how many more bytes StreamEncrypt writes than it reads,
+// the initialisation vector in front of the content
+const Overhead = aes.BlockSize
+
 func GenerateID() string {
 	buffer := make([]byte, 32)
 	io.ReadFull(rand.Reader, buffer)
@@ -27,7 +33,19 @@ func NewEncryptionKey() []byte {
 	return keyBuffer
 }
 
+// NewNodeKey generates the key a node authenticates itself with to its peers
+func NewNodeKey() ed25519.PrivateKey {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	return key
+}
+
 func StreamDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	return StreamDecryptContext(context.Background(), key, src, dst)
+}
+
+// StreamDecryptContext is StreamDecrypt which stops
+// between two buffers once the ctx is done
+func StreamDecryptContext(ctx context.Context, key []byte, src io.Reader, dst io.Writer) (int, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return 0, err
@@ -46,6 +64,10 @@ func StreamDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	)
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
 		n, err := src.Read(buffer)
 		if n > 0 {
 			stream.XORKeyStream(buffer, buffer[:n])
@@ -68,6 +90,12 @@ func StreamDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 }
 
 func StreamEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	return StreamEncryptContext(context.Background(), key, src, dst)
+}
+
+// StreamEncryptContext is StreamEncrypt which stops
+// between two buffers once the ctx is done
+func StreamEncryptContext(ctx context.Context, key []byte, src io.Reader, dst io.Writer) (int, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return 0, err
@@ -91,6 +119,10 @@ func StreamEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	)
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
 		n, err := src.Read(buffer)
 		if n > 0 {
 			stream.XORKeyStream(buffer, buffer[:n])
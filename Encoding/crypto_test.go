@@ -2,6 +2,8 @@ package enc
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -26,4 +28,13 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Error("decrypted message does not match input")
 	}
 	fmt.Println(out.String())
-}
\ No newline at end of file
+}
+func TestEncryptCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	src := bytes.NewReader([]byte("Bar not Foooo"))
+	if _, err := StreamEncryptContext(ctx, NewEncryptionKey(), src, new(bytes.Buffer)); !errors.Is(err, context.Canceled) {
+		t.Errorf("wanted %s, got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,403 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defining how often a member is probed
+	defaultProbeInterval = time.Second
+
+	// defining how many members are asked to probe a member which did not answer
+	defaultIndirectProbes = 3
+
+	// defining how often an update is piggybacked, multiplied by the log of the cluster size
+	defaultRetransmitMultiplier = 4
+
+	// defining how many updates a single message carries at most
+	maxPiggyback = 16
+)
+
+// ErrUnreachable is returned by HandlePingReq when the target did not answer
+var ErrUnreachable = errors.New("member unreachable")
+
+// Network carries the messages of the protocol to other members.
+// The receiving member answers them through the Handle methods of its Gossip.
+type Network interface {
+	// Ping sends the updates to a member and returns the ones it answered with
+	Ping(ctx context.Context, to Member, updates []Member) ([]Member, error)
+
+	// PingReq asks via to ping target on behalf of this member,
+	// it fails if target did not answer via either
+	PingReq(ctx context.Context, via Member, target Member, updates []Member) ([]Member, error)
+}
+
+type Config struct {
+	// Self is this member, it is always Alive to itself
+	Self    Member
+	Network Network
+
+	// ProbeInterval is how often a member is probed, ProbeTimeout how long
+	// it has to answer before others are asked to probe it, half of ProbeInterval if 0.
+	// SuspicionTimeout is how long a Suspect has to refute before it is Dead,
+	// five times ProbeInterval if 0. They are read on every protocol period.
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	SuspicionTimeout time.Duration
+
+	// IndirectProbes is the number of members asked to probe a member which did not answer
+	IndirectProbes int
+
+	// OnChange is called with every member whose state changed.
+	// It runs in a goroutine of its own, so changes may arrive out of order
+	// and Member returns the current state.
+	OnChange func(Member)
+}
+
+// update is a change about a member which is still being spread
+type update struct {
+	member    Member
+	transmits int
+}
+
+// Gossip keeps the view a node has of the members of the cluster, following SWIM:
+// every ProbeInterval one member is pinged, directly and if it does not answer
+// through others, and what changed about members is piggybacked on the pings
+// and their answers until every member heard of it.
+type Gossip struct {
+	Config
+
+	lock    sync.Mutex
+	members map[string]Member
+	updates []*update
+
+	// suspected holds when every Suspect became one
+	suspected map[string]time.Time
+
+	// probes is the order the members are probed in, reshuffled on every pass
+	probes []string
+}
+
+func New(config Config) *Gossip {
+	if config.ProbeInterval == 0 {
+		config.ProbeInterval = defaultProbeInterval
+	}
+
+	if config.IndirectProbes == 0 {
+		config.IndirectProbes = defaultIndirectProbes
+	}
+
+	config.Self.State = Alive
+
+	g := &Gossip{
+		Config:    config,
+		members:   map[string]Member{config.Self.ID: config.Self},
+		suspected: make(map[string]time.Time),
+	}
+
+	// a new member announces itself to the ones it pings first
+	g.spread(config.Self)
+	return g
+}
+
+// Members returns every member known, this one included, sorted by ID
+func (g *Gossip) Members() []Member {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	members := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, m)
+	}
+	slices.SortFunc(members, func(a, b Member) int { return strings.Compare(a.ID, b.ID) })
+	return members
+}
+
+func (g *Gossip) Member(id string) (Member, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	m, ok := g.members[id]
+	return m, ok
+}
+
+// Join records a member this one learned about outside of the protocol,
+// like a peer it connected to. A known member is left as it is,
+// a member coming back from the dead refutes that itself
+// once it hears about it, so that is spread again.
+func (g *Gossip) Join(m Member) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	known, ok := g.members[m.ID]
+	switch {
+	case !ok:
+		m.State, m.Incarnation = Alive, 0
+		g.set(m)
+	case known.gone():
+		g.spread(known)
+	}
+}
+
+// Leave announces that this member leaves the cluster
+func (g *Gossip) Leave() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	self := g.members[g.Self.ID]
+	self.State = Left
+	g.set(self)
+}
+
+// Apply merges updates about members into the view
+func (g *Gossip) Apply(updates []Member) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, u := range updates {
+		g.apply(u)
+	}
+}
+
+func (g *Gossip) apply(u Member) {
+	m, known := g.members[u.ID]
+
+	if u.ID == g.Self.ID {
+		// others may only believe this member is alive, unless it left
+		if m.State != Left && u.State != Alive && u.Incarnation >= m.Incarnation {
+			m.Incarnation = u.Incarnation + 1
+			g.set(m)
+		}
+		return
+	}
+
+	if known && !u.overrides(m) {
+		return
+	}
+	g.set(u)
+}
+
+// set records a change about a member and spreads it, caller holds lock
+func (g *Gossip) set(m Member) {
+	g.members[m.ID] = m
+
+	if m.State == Suspect {
+		g.suspected[m.ID] = time.Now()
+	} else {
+		delete(g.suspected, m.ID)
+	}
+
+	g.spread(m)
+
+	if g.OnChange != nil {
+		go g.OnChange(m)
+	}
+}
+
+// spread queues what is known about a member to be piggybacked, caller holds lock
+func (g *Gossip) spread(m Member) {
+	g.updates = slices.DeleteFunc(g.updates, func(u *update) bool { return u.member.ID == m.ID })
+	g.updates = append(g.updates, &update{member: m})
+}
+
+// piggyback returns the updates to send with the next message,
+// the ones sent least often first, and drops those spread enough
+func (g *Gossip) piggyback() []Member {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	limit := defaultRetransmitMultiplier * int(math.Ceil(math.Log2(float64(len(g.members)+1))))
+
+	slices.SortStableFunc(g.updates, func(a, b *update) int { return a.transmits - b.transmits })
+
+	var updates []Member
+	for _, u := range g.updates {
+		if len(updates) == maxPiggyback {
+			break
+		}
+		updates = append(updates, u.member)
+		u.transmits++
+	}
+	g.updates = slices.DeleteFunc(g.updates, func(u *update) bool { return u.transmits >= limit })
+
+	return updates
+}
+
+func (g *Gossip) probeTimeout() time.Duration {
+	if g.ProbeTimeout == 0 {
+		return g.ProbeInterval / 2
+	}
+	return g.ProbeTimeout
+}
+
+func (g *Gossip) suspicionTimeout() time.Duration {
+	if g.SuspicionTimeout == 0 {
+		return 5 * g.ProbeInterval
+	}
+	return g.SuspicionTimeout
+}
+
+// HandlePing answers a ping from another member
+func (g *Gossip) HandlePing(updates []Member) []Member {
+	g.Apply(updates)
+	return g.piggyback()
+}
+
+// HandlePingReq pings target on behalf of another member
+func (g *Gossip) HandlePingReq(ctx context.Context, target Member, updates []Member) ([]Member, error) {
+	g.Apply(updates)
+
+	ctx, cancel := context.WithTimeout(ctx, g.probeTimeout())
+	defer cancel()
+
+	answer, err := g.Network.Ping(ctx, target, g.piggyback())
+	if err != nil {
+		return nil, ErrUnreachable
+	}
+	g.Apply(answer)
+
+	return g.piggyback(), nil
+}
+
+// Run probes a member every ProbeInterval until the ctx is done
+func (g *Gossip) Run(ctx context.Context) {
+	ticker := time.NewTicker(g.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.probe(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probe runs one protocol period: the next member is pinged and, if it does not
+// answer, IndirectProbes others are asked to ping it. A member nobody reached is suspected.
+func (g *Gossip) probe(ctx context.Context) {
+	g.expireSuspects()
+
+	target, ok := g.nextTarget()
+	if !ok {
+		return
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, g.probeTimeout())
+	answer, err := g.Network.Ping(pingCtx, target, g.piggyback())
+	cancel()
+	if err == nil {
+		g.Apply(answer)
+		return
+	}
+
+	if g.probeIndirectly(ctx, target) {
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	// the view may have changed while probing
+	if m := g.members[target.ID]; m.State == Alive && m.Incarnation == target.Incarnation {
+		m.State = Suspect
+		g.set(m)
+		log.Printf("[%s] Suspecting %s at %s", g.Self.Addr, m.ID, m.Addr)
+	}
+}
+
+// probeIndirectly asks other members to ping target and reports whether any reached it
+func (g *Gossip) probeIndirectly(ctx context.Context, target Member) bool {
+	g.lock.Lock()
+	var helpers []Member
+	for _, m := range g.members {
+		if m.ID != g.Self.ID && m.ID != target.ID && m.State == Alive {
+			helpers = append(helpers, m)
+		}
+	}
+	g.lock.Unlock()
+
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	helpers = helpers[:min(len(helpers), g.IndirectProbes)]
+	if len(helpers) == 0 {
+		return false
+	}
+
+	// the helpers get the time to ping target themselves
+	ctx, cancel := context.WithTimeout(ctx, 2*g.probeTimeout())
+	defer cancel()
+
+	reached := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper Member) {
+			answer, err := g.Network.PingReq(ctx, helper, target, g.piggyback())
+			if err == nil {
+				g.Apply(answer)
+			}
+			reached <- err == nil
+		}(helper)
+	}
+
+	for range helpers {
+		if <-reached {
+			return true
+		}
+	}
+	return false
+}
+
+// nextTarget returns the next member to probe, going through
+// the members which are not gone in a random order
+func (g *Gossip) nextTarget() (Member, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for {
+		if len(g.probes) == 0 {
+			for id, m := range g.members {
+				if id != g.Self.ID && !m.gone() {
+					g.probes = append(g.probes, id)
+				}
+			}
+			if len(g.probes) == 0 {
+				return Member{}, false
+			}
+			rand.Shuffle(len(g.probes), func(i, j int) { g.probes[i], g.probes[j] = g.probes[j], g.probes[i] })
+		}
+
+		id := g.probes[0]
+		g.probes = g.probes[1:]
+		if m := g.members[id]; !m.gone() {
+			return m, true
+		}
+	}
+}
+
+// expireSuspects declares the members Dead which did not refute the suspicion in time
+func (g *Gossip) expireSuspects() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for id, since := range g.suspected {
+		if time.Since(since) < g.suspicionTimeout() {
+			continue
+		}
+
+		m := g.members[id]
+		m.State = Dead
+		g.set(m)
+		log.Printf("[%s] Declaring %s at %s dead", g.Self.Addr, m.ID, m.Addr)
+	}
+}
@@ -0,0 +1,216 @@
+package gossip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cluster delivers the messages between members in the same process
+type cluster struct {
+	lock    sync.Mutex
+	nodes   map[string]*Gossip
+	down    map[string]bool
+	blocked map[[2]string]bool
+}
+
+func (c *cluster) node(from, to string) (*Gossip, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	g, ok := c.nodes[to]
+	if !ok || c.down[to] || c.down[from] || c.blocked[[2]string{from, to}] {
+		return nil, fmt.Errorf("member %s unreachable from %s", to, from)
+	}
+	return g, nil
+}
+
+// memoryNetwork is the view of the cluster from one member
+type memoryNetwork struct {
+	cluster *cluster
+	from    string
+}
+
+func (n memoryNetwork) Ping(ctx context.Context, to Member, updates []Member) ([]Member, error) {
+	g, err := n.cluster.node(n.from, to.ID)
+	if err != nil {
+		return nil, err
+	}
+	return g.HandlePing(updates), nil
+}
+
+func (n memoryNetwork) PingReq(ctx context.Context, via Member, target Member, updates []Member) ([]Member, error) {
+	g, err := n.cluster.node(n.from, via.ID)
+	if err != nil {
+		return nil, err
+	}
+	return g.HandlePingReq(ctx, target, updates)
+}
+
+func newCluster(size int) (*cluster, []*Gossip) {
+	c := &cluster{
+		nodes:   make(map[string]*Gossip),
+		down:    make(map[string]bool),
+		blocked: make(map[[2]string]bool),
+	}
+
+	nodes := make([]*Gossip, size)
+	for i := range nodes {
+		id := fmt.Sprintf("node%d", i)
+		nodes[i] = New(Config{
+			Self:             Member{ID: id, Addr: fmt.Sprintf(":%d", 5000+i)},
+			Network:          memoryNetwork{cluster: c, from: id},
+			ProbeTimeout:     100 * time.Millisecond,
+			SuspicionTimeout: time.Millisecond,
+		})
+		c.nodes[id] = nodes[i]
+	}
+
+	return c, nodes
+}
+
+// rounds runs protocol periods on the nodes which are not down
+func (c *cluster) rounds(n int, nodes ...*Gossip) {
+	for i := 0; i < n; i++ {
+		for _, g := range nodes {
+			c.lock.Lock()
+			down := c.down[g.Self.ID]
+			c.lock.Unlock()
+
+			if !down {
+				g.probe(context.Background())
+			}
+		}
+	}
+}
+
+// joinAll lets every node know all the others
+func joinAll(nodes []*Gossip) {
+	for _, g := range nodes {
+		for _, other := range nodes {
+			g.Join(other.Self)
+		}
+	}
+}
+
+func TestGossipSpreadsMembers(t *testing.T) {
+	c, nodes := newCluster(6)
+
+	// every node only knows the one which joined before it
+	for i := 1; i < len(nodes); i++ {
+		nodes[i].Join(nodes[i-1].Self)
+	}
+	c.rounds(20, nodes...)
+
+	for _, g := range nodes {
+		members := g.Members()
+		assert.Len(t, members, len(nodes), g.Self.ID)
+		for _, m := range members {
+			assert.Equal(t, Alive, m.State, "%s about %s", g.Self.ID, m.ID)
+		}
+	}
+}
+
+func TestGossipFailureDetection(t *testing.T) {
+	c, nodes := newCluster(4)
+	joinAll(nodes)
+
+	failed := nodes[3]
+	c.down[failed.Self.ID] = true
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.rounds(1, nodes...)
+		time.Sleep(time.Millisecond)
+
+		dead := 0
+		for _, g := range nodes[:3] {
+			if m, _ := g.Member(failed.Self.ID); m.State == Dead {
+				dead++
+			}
+		}
+		if dead == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted %s dead to every node, dead to %d", failed.Self.ID, dead)
+		}
+	}
+
+	// the dead member is not probed anymore
+	for _, g := range nodes[:3] {
+		for i := 0; i < 10; i++ {
+			target, _ := g.nextTarget()
+			assert.NotEqual(t, failed.Self.ID, target.ID)
+		}
+	}
+}
+
+func TestGossipIndirectProbe(t *testing.T) {
+	c, nodes := newCluster(3)
+	joinAll(nodes)
+
+	// the link between the first and the last node is down, the middle one reaches both
+	c.blocked[[2]string{nodes[0].Self.ID, nodes[2].Self.ID}] = true
+	c.rounds(20, nodes[0])
+
+	m, _ := nodes[0].Member(nodes[2].Self.ID)
+	assert.Equal(t, Alive, m.State)
+}
+
+func TestGossipRefute(t *testing.T) {
+	c, nodes := newCluster(2)
+	joinAll(nodes)
+
+	// a suspicion about a member is refuted with a new incarnation
+	suspect := nodes[1].Self
+	suspect.State = Suspect
+	nodes[0].Apply([]Member{suspect})
+
+	c.rounds(5, nodes...)
+
+	m, _ := nodes[0].Member(suspect.ID)
+	assert.Equal(t, Alive, m.State)
+	assert.Equal(t, uint64(1), m.Incarnation)
+
+	self, _ := nodes[1].Member(suspect.ID)
+	assert.Equal(t, Alive, self.State)
+	assert.Equal(t, uint64(1), self.Incarnation)
+}
+
+func TestGossipRejoin(t *testing.T) {
+	c, nodes := newCluster(2)
+	joinAll(nodes)
+
+	dead := nodes[1].Self
+	dead.State = Dead
+	nodes[0].Apply([]Member{dead})
+
+	// the member comes back as a new process, knowing nothing
+	restarted := New(Config{Self: nodes[1].Self, Network: memoryNetwork{cluster: c, from: dead.ID}})
+	c.nodes[dead.ID] = restarted
+	restarted.Join(nodes[0].Self)
+	nodes[0].Join(restarted.Self)
+
+	c.rounds(5, nodes[0], restarted)
+
+	m, _ := nodes[0].Member(dead.ID)
+	assert.Equal(t, Alive, m.State)
+}
+
+func TestGossipLeave(t *testing.T) {
+	c, nodes := newCluster(4)
+	joinAll(nodes)
+
+	nodes[0].Leave()
+	c.rounds(10, nodes...)
+
+	for _, g := range nodes[1:] {
+		m, _ := g.Member(nodes[0].Self.ID)
+		assert.Equal(t, Left, m.State, g.Self.ID)
+	}
+}
@@ -0,0 +1,62 @@
+package gossip
+
+import "fmt"
+
+// State is what a node believes about a member
+type State int
+
+const (
+	// Alive members answer to pings
+	Alive State = iota
+
+	// Suspect members did not answer to a ping, directly or through others.
+	// They are declared Dead unless they refute it before the suspicion times out.
+	Suspect
+
+	// Dead members stopped answering, Left members announced they leave
+	Dead
+	Left
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	case Left:
+		return "left"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// Member is a node of the cluster as one node sees it.
+// Incarnation is only ever raised by the member itself, to refute a suspicion.
+type Member struct {
+	ID          string
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+// gone reports whether the member is out of the cluster
+func (m Member) gone() bool {
+	return m.State == Dead || m.State == Left
+}
+
+// overrides reports whether the update u about a member
+// replaces what is known about it as m, following SWIM:
+// a newer incarnation wins and within an incarnation
+// suspicion beats being alive and leaving the cluster beats both
+func (u Member) overrides(m Member) bool {
+	switch u.State {
+	case Alive:
+		return u.Incarnation > m.Incarnation
+	case Suspect:
+		return u.Incarnation > m.Incarnation || (u.Incarnation == m.Incarnation && m.State == Alive)
+	default:
+		return u.Incarnation > m.Incarnation || (u.Incarnation == m.Incarnation && !m.gone())
+	}
+}
@@ -0,0 +1,36 @@
+package gossip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemberOverrides(t *testing.T) {
+	member := func(state State, incarnation uint64) Member {
+		return Member{ID: "node", State: state, Incarnation: incarnation}
+	}
+
+	cases := []struct {
+		update, known Member
+		overrides     bool
+	}{
+		{member(Alive, 1), member(Alive, 0), true},
+		{member(Alive, 1), member(Alive, 1), false},
+		{member(Alive, 1), member(Suspect, 1), false},
+		{member(Alive, 2), member(Suspect, 1), true},
+		{member(Alive, 2), member(Dead, 1), true},
+		{member(Suspect, 1), member(Alive, 1), true},
+		{member(Suspect, 1), member(Suspect, 1), false},
+		{member(Suspect, 0), member(Alive, 1), false},
+		{member(Suspect, 1), member(Dead, 1), false},
+		{member(Dead, 1), member(Suspect, 1), true},
+		{member(Dead, 1), member(Alive, 2), false},
+		{member(Left, 1), member(Dead, 1), false},
+		{member(Left, 1), member(Alive, 1), true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.overrides, c.update.overrides(c.known), "%+v over %+v", c.update, c.known)
+	}
+}
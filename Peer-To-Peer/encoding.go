@@ -1,29 +1,133 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net"
 )
 
+// defining the largest payload a single frame may carry
+const DefaultMaxFrameSize = 1 << 20
+
+// ErrFrameTooLarge is returned for a frame whose payload exceeds the maximum frame size
+var ErrFrameTooLarge = errors.New("frame exceeds the maximum frame size")
+
 type Decoder interface {
 	Decode(io.Reader, *RPC) error
 }
 
+// Encoder writes an RPC on the wire in the form its matching Decoder reads it
+type Encoder interface {
+	Encode(io.Writer, *RPC) error
+}
+
 type GOBDecoder struct{}
 
 func (dec GOBDecoder) Decode(r io.Reader, msg *RPC) error {
 	return gob.NewDecoder(r).Decode(msg)
 }
 
+// FrameEncoder writes every RPC as a frame: a type byte, the stream ID
+// as a varint for frames of a stream, the length of the payload
+// as a varint and the payload itself.
+type FrameEncoder struct {
+	// MaxFrameSize is the largest payload allowed, DefaultMaxFrameSize if zero
+	MaxFrameSize int
+}
+
+func (e FrameEncoder) Encode(w io.Writer, msg *RPC) error {
+	if len(msg.Payload) > maxFrameSize(e.MaxFrameSize) {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(msg.Payload))
+	}
+
+	header := make([]byte, 1, 1+2*binary.MaxVarintLen64)
+	header[0] = TypeMessage
+	if msg.Stream {
+		header[0] = msg.Type
+		header = binary.AppendUvarint(header, uint64(msg.StreamID))
+	}
+	header = binary.AppendUvarint(header, uint64(len(msg.Payload)))
+
+	// the frame may still be written in several parts, so concurrent
+	// writers to one connection have to serialize their calls
+	frame := net.Buffers{header, msg.Payload}
+	_, err := frame.WriteTo(w)
+	return err
+}
+
+// FrameDecoder reads the frames written by FrameEncoder
+// and never reads past the end of a frame.
+type FrameDecoder struct {
+	// MaxFrameSize is the largest payload accepted, DefaultMaxFrameSize if zero
+	MaxFrameSize int
+}
+
+func (dec FrameDecoder) Decode(r io.Reader, msg *RPC) error {
+	br := &byteReader{Reader: r}
+
+	frameType, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	switch frameType {
+	case TypeMessage:
+	case TypeStream, TypeStreamClose, TypeStreamWindow:
+		id, err := binary.ReadUvarint(br)
+		if err != nil {
+			return err
+		}
+		if id > math.MaxUint32 {
+			return fmt.Errorf("invalid stream id (%d)", id)
+		}
+
+		msg.Stream = true
+		msg.Type = frameType
+		msg.StreamID = uint32(id)
+	default:
+		return fmt.Errorf("unknown frame type (%#x)", frameType)
+	}
+
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+
+	// an oversized payload is still consumed to keep the connection in sync
+	if size > uint64(maxFrameSize(dec.MaxFrameSize)) {
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+
+	// the payload buffer passed in is reused if it is large enough
+	if uint64(cap(msg.Payload)) >= size {
+		msg.Payload = msg.Payload[:size]
+	} else {
+		msg.Payload = make([]byte, size)
+	}
+	_, err = io.ReadFull(r, msg.Payload)
+	return err
+}
+
+// DefaultDecoder reads a type byte followed by whatever payload
+// a single read returns.
+//
+// Deprecated: DefaultDecoder cannot tell where a message ends and does not
+// understand the frames of multiplexed streams, use FrameDecoder instead.
 type DefaultDecoder struct{}
 
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-	
 	peekBuffer := make([]byte, 1)
 	if _, err := r.Read(peekBuffer); err != nil {
 		return err
 	}
-	
+
 	// If stream is true, we do not want to decode
 	stream := peekBuffer[0] == TypeStream
 	if stream {
@@ -31,7 +135,6 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 		return nil
 	}
 
-	
 	buf := make([]byte, 1028)
 	n, err := r.Read(buf)
 	if err != nil {
@@ -41,3 +144,23 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 
 	return nil
 }
+
+func maxFrameSize(size int) int {
+	if size <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return size
+}
+
+// byteReader reads a single byte at a time without buffering
+type byteReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (br *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(br.Reader, br.b[:]); err != nil {
+		return 0, err
+	}
+	return br.b[0], nil
+}
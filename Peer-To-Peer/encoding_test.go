@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameEncodeDecode(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 4096)
+	wire := new(bytes.Buffer)
+
+	enc := FrameEncoder{}
+	assert.Nil(t, enc.Encode(wire, &RPC{Payload: large}))
+	assert.Nil(t, enc.Encode(wire, &RPC{Payload: []byte("second")}))
+	assert.Nil(t, enc.Encode(wire, &RPC{Stream: true, Type: TypeStream, StreamID: 7, Payload: []byte("stream data")}))
+	wire.WriteString("next")
+
+	dec := FrameDecoder{}
+
+	first := RPC{}
+	assert.Nil(t, dec.Decode(wire, &first))
+	assert.Equal(t, large, first.Payload)
+
+	second := RPC{}
+	assert.Nil(t, dec.Decode(wire, &second))
+	assert.Equal(t, []byte("second"), second.Payload)
+
+	stream := RPC{}
+	assert.Nil(t, dec.Decode(wire, &stream))
+	assert.True(t, stream.Stream)
+	assert.Equal(t, uint32(7), stream.StreamID)
+	assert.Equal(t, []byte("stream data"), stream.Payload)
+
+	// nothing past the last frame is read
+	assert.Equal(t, "next", wire.String())
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	wire := new(bytes.Buffer)
+
+	assert.True(t, errors.Is(FrameEncoder{MaxFrameSize: 8}.Encode(wire, &RPC{Payload: []byte("way too large")}), ErrFrameTooLarge))
+
+	FrameEncoder{}.Encode(wire, &RPC{Payload: []byte("way too large")})
+	FrameEncoder{}.Encode(wire, &RPC{Payload: []byte("fits")})
+
+	dec := FrameDecoder{MaxFrameSize: 8}
+	assert.True(t, errors.Is(dec.Decode(wire, &RPC{}), ErrFrameTooLarge))
+
+	// the oversized frame is skipped and the next one is still readable
+	msg := RPC{}
+	assert.Nil(t, dec.Decode(wire, &msg))
+	assert.Equal(t, []byte("fits"), msg.Payload)
+}
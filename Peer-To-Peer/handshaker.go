@@ -1,5 +1,189 @@
 package p2p
 
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
 type HandshakeFunc func(Peer) error
 
 func NOPHandshakeFunc(Peer) error { return nil }
+
+const (
+	// defining the version of the protocol spoken between nodes
+	ProtocolVersion = 1
+
+	// defining how long the node handshake may take
+	handshakeTimeout = 10 * time.Second
+
+	// defining the largest handshake message accepted
+	maxHandshakeSize = 64 * 1024
+
+	// FeatureStreams is announced by nodes which multiplex streams over the connection
+	FeatureStreams = "streams"
+)
+
+var (
+	ErrIncompatibleVersion = errors.New("incompatible protocol version")
+	ErrInvalidSignature    = errors.New("invalid handshake signature")
+)
+
+// NodeInfo describes a node to the peers it connects with
+type NodeInfo struct {
+	ID         string
+	ListenAddr string
+	Version    uint32
+	Features   []string
+}
+
+// HasFeature reports whether the node supports the feature
+func (info NodeInfo) HasFeature(feature string) bool {
+	return slices.Contains(info.Features, feature)
+}
+
+// NodeIDFromKey derives the node ID belonging to a node key
+func NodeIDFromKey(key ed25519.PublicKey) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:])
+}
+
+// hello is the first handshake message sent by both ends
+type hello struct {
+	Info      NodeInfo
+	PublicKey ed25519.PublicKey
+
+	// Nonce is the challenge the remote has to sign
+	Nonce []byte
+}
+
+// NodeHandshakeFunc authenticates both ends of a connection with their node keys.
+//
+// Both ends send a hello carrying their NodeInfo, their public key and a random nonce.
+// Then each end signs the nonce of the remote together with its own hello, which
+// proves it holds the key of the ID it claims and that the hello was not tampered with.
+// The ID of a node must be derived from its key by NodeIDFromKey.
+func NodeHandshakeFunc(info NodeInfo, key ed25519.PrivateKey) HandshakeFunc {
+	if info.Version == 0 {
+		info.Version = ProtocolVersion
+	}
+
+	return func(peer Peer) error {
+		p, ok := peer.(*TCPPeer)
+		if !ok {
+			return fmt.Errorf("unsupported peer type %T", peer)
+		}
+
+		p.SetDeadline(time.Now().Add(handshakeTimeout))
+		defer p.SetDeadline(time.Time{})
+
+		local := hello{
+			Info:      info,
+			PublicKey: key.Public().(ed25519.PublicKey),
+			Nonce:     make([]byte, 32),
+		}
+		if _, err := io.ReadFull(rand.Reader, local.Nonce); err != nil {
+			return err
+		}
+
+		localHello := new(bytes.Buffer)
+		if err := gob.NewEncoder(localHello).Encode(local); err != nil {
+			return err
+		}
+		if err := writeHandshake(p, localHello.Bytes()); err != nil {
+			return err
+		}
+
+		remoteHello, err := readHandshake(p)
+		if err != nil {
+			return err
+		}
+
+		var remote hello
+		if err := gob.NewDecoder(bytes.NewReader(remoteHello)).Decode(&remote); err != nil {
+			return err
+		}
+
+		if err := writeHandshake(p, ed25519.Sign(key, handshakeProof(remote.Nonce, localHello.Bytes()))); err != nil {
+			return err
+		}
+
+		signature, err := readHandshake(p)
+		if err != nil {
+			return err
+		}
+
+		if err := verifyHello(remote, info); err != nil {
+			return err
+		}
+		if !ed25519.Verify(remote.PublicKey, handshakeProof(local.Nonce, remoteHello), signature) {
+			return ErrInvalidSignature
+		}
+
+		// an outbound peer keeps the address it was dialed on if it does not announce one
+		if len(remote.Info.ListenAddr) == 0 {
+			remote.Info.ListenAddr = p.info.ListenAddr
+		}
+		p.info = remote.Info
+		return nil
+	}
+}
+
+func verifyHello(remote hello, local NodeInfo) error {
+	if remote.Info.Version != local.Version {
+		return fmt.Errorf("%w: remote speaks %d, we speak %d", ErrIncompatibleVersion, remote.Info.Version, local.Version)
+	}
+
+	if len(remote.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key of %d bytes", len(remote.PublicKey))
+	}
+
+	if remote.Info.ID != NodeIDFromKey(remote.PublicKey) {
+		return fmt.Errorf("node ID (%s) does not belong to its key", remote.Info.ID)
+	}
+
+	if remote.Info.ID == local.ID {
+		return fmt.Errorf("connected to ourselves (%s)", local.ID)
+	}
+
+	return nil
+}
+
+// handshakeProof is what a node signs to answer the challenge of the remote
+func handshakeProof(nonce []byte, hello []byte) []byte {
+	proof := []byte("dfs-node-handshake")
+	proof = append(proof, nonce...)
+	return append(proof, hello...)
+}
+
+// Handshake messages are exchanged before the connection is read by the transport,
+// so they use a framing of their own: a 4 byte length followed by the message
+func writeHandshake(w io.Writer, msg []byte) error {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+func readHandshake(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	if size > maxHandshakeSize {
+		return nil, fmt.Errorf("%w: handshake message of %d bytes", ErrFrameTooLarge, size)
+	}
+
+	msg := make([]byte, size)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
@@ -0,0 +1,84 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newNodeTransport(t *testing.T, listenAddress string, info NodeInfo, key ed25519.PrivateKey, peers chan Peer) *TCPTransport {
+	transport := NewTCPTransport(TCPTransportConfig{
+		ListenAddress: listenAddress,
+		HandshakeFunc: NodeHandshakeFunc(info, key),
+		PeerStatus: func(p Peer) error {
+			peers <- p
+			return nil
+		},
+	})
+
+	if len(listenAddress) > 0 {
+		assert.Nil(t, transport.ListenAndAccept())
+		t.Cleanup(func() { transport.Close() })
+	}
+	return transport
+}
+
+func newNodeKey(t *testing.T) (ed25519.PrivateKey, string) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	return key, NodeIDFromKey(pub)
+}
+
+func TestNodeHandshake(t *testing.T) {
+	serverKey, serverID := newNodeKey(t)
+	clientKey, clientID := newNodeKey(t)
+	serverPeers, clientPeers := make(chan Peer, 1), make(chan Peer, 1)
+
+	newNodeTransport(t, ":9120", NodeInfo{ID: serverID, ListenAddr: ":9120", Features: []string{"streams"}}, serverKey, serverPeers)
+	client := newNodeTransport(t, "", NodeInfo{ID: clientID, ListenAddr: ":9121"}, clientKey, clientPeers)
+	assert.Nil(t, client.Dial(":9120"))
+
+	// both ends know who is on the other side
+	server := <-serverPeers
+	assert.Equal(t, clientID, server.ID())
+	assert.Equal(t, ":9121", server.Info().ListenAddr)
+
+	remote := <-clientPeers
+	assert.Equal(t, serverID, remote.ID())
+	assert.Equal(t, uint32(ProtocolVersion), remote.Info().Version)
+	assert.True(t, remote.Info().HasFeature("streams"))
+}
+
+func TestNodeHandshakeRejected(t *testing.T) {
+	clientKey, clientID := newNodeKey(t)
+	_, otherID := newNodeKey(t)
+
+	tests := []struct {
+		name          string
+		listenAddress string
+		info          NodeInfo
+	}{
+		{"foreign ID", ":9122", NodeInfo{ID: otherID}},
+		{"unknown version", ":9123", NodeInfo{ID: clientID, Version: ProtocolVersion + 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverKey, serverID := newNodeKey(t)
+			serverPeers := make(chan Peer, 1)
+			newNodeTransport(t, test.listenAddress, NodeInfo{ID: serverID}, serverKey, serverPeers)
+
+			client := newNodeTransport(t, "", test.info, clientKey, make(chan Peer, 1))
+			assert.Nil(t, client.Dial(test.listenAddress))
+
+			select {
+			case p := <-serverPeers:
+				t.Errorf("expected no peer, but %s connected", p.ID())
+			case <-time.After(200 * time.Millisecond):
+			}
+		})
+	}
+}
@@ -2,7 +2,11 @@ package p2p
 
 const (
 	TypeMessage = 0x0
-	TypeStream  = 0x1
+
+	// Frames belonging to a stream multiplexed over the connection
+	TypeStream       = 0x1 // data written to the stream
+	TypeStreamClose  = 0x2 // the sender is done with the stream
+	TypeStreamWindow = 0x3 // the receiver consumed data, the sender may send more
 )
 
 // Message holds any arbitrary data being sent over each transport
@@ -10,5 +14,10 @@ const (
 type RPC struct {
 	From    string
 	Payload []byte
-	Stream  bool
+
+	// Stream is true for frames of a stream, which are handled by the peer
+	// and never handed to the consumer of the transport
+	Stream   bool
+	Type     byte
+	StreamID uint32
 }
@@ -0,0 +1,193 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// defining how many bytes of a stream may be in flight
+	// before the sender waits for the receiver to read them
+	StreamWindow = 256 * 1024
+
+	// defining the largest piece of a stream sent in a single frame
+	streamFrameSize = 32 * 1024
+)
+
+// ErrStreamClosed is returned when writing to a stream
+// that was closed on either end of the connection
+var ErrStreamClosed = errors.New("stream closed")
+
+// stream is one direction-agnostic byte stream multiplexed over a TCPPeer.
+// Every stream has its own flow control window: the receiver buffers at most
+// StreamWindow bytes and grants more to the sender as it reads them,
+// so a slow stream never holds up the connection or the other streams.
+type stream struct {
+	id   uint32
+	peer *TCPPeer
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// received but not yet read
+	buffer bytes.Buffer
+	// read but not yet granted back to the sender
+	consumed uint32
+	// bytes which may still be sent before the receiver grants more
+	sendWindow uint32
+
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newStream(id uint32, peer *TCPPeer) *stream {
+	s := &stream{
+		id:         id,
+		peer:       peer,
+		sendWindow: StreamWindow,
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+func (s *stream) ID() uint32 {
+	return s.id
+}
+
+// Read blocks until data arrives and returns io.EOF once
+// everything sent before the remote closed the stream was read
+func (s *stream) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	for s.buffer.Len() == 0 && !s.remoteClosed && !s.localClosed && s.err == nil {
+		s.cond.Wait()
+	}
+
+	if s.buffer.Len() == 0 {
+		defer s.lock.Unlock()
+		switch {
+		case s.err != nil:
+			return 0, s.err
+		case s.localClosed:
+			return 0, ErrStreamClosed
+		}
+		return 0, io.EOF
+	}
+
+	n, _ := s.buffer.Read(p)
+
+	// the window is granted back in batches to keep the number of frames low
+	var grant uint32
+	s.consumed += uint32(n)
+	if s.consumed >= StreamWindow/2 {
+		grant, s.consumed = s.consumed, 0
+	}
+	s.lock.Unlock()
+
+	if grant > 0 {
+		s.peer.sendStreamFrame(TypeStreamWindow, s.id, binary.AppendUvarint(nil, uint64(grant)))
+	}
+
+	return n, nil
+}
+
+// Write blocks while the sender window is used up
+func (s *stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		s.lock.Lock()
+		for s.sendWindow == 0 && !s.localClosed && !s.remoteClosed && s.err == nil {
+			s.cond.Wait()
+		}
+
+		switch {
+		case s.err != nil:
+			s.lock.Unlock()
+			return written, s.err
+		case s.localClosed || s.remoteClosed:
+			s.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		size := min(uint32(len(p)), s.sendWindow, streamFrameSize)
+		s.sendWindow -= size
+		s.lock.Unlock()
+
+		if err := s.peer.sendStreamFrame(TypeStream, s.id, p[:size]); err != nil {
+			return written, err
+		}
+		written += int(size)
+		p = p[size:]
+	}
+
+	return written, nil
+}
+
+// Close ends the stream on both sides: the remote reads io.EOF after
+// whatever was already written, and writes on either side fail from then on.
+func (s *stream) Close() error {
+	s.lock.Lock()
+	if s.localClosed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	s.buffer.Reset()
+	remoteClosed := s.remoteClosed
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	if remoteClosed {
+		s.peer.removeStream(s.id)
+	}
+
+	return s.peer.sendStreamFrame(TypeStreamClose, s.id, nil)
+}
+
+// handleFrame is called by the read loop of the connection
+// for every frame received on this stream
+func (s *stream) handleFrame(rpc *RPC) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer s.cond.Broadcast()
+
+	switch rpc.Type {
+	case TypeStream:
+		// the data still arrives after a local close, but nobody reads it
+		if s.localClosed {
+			return nil
+		}
+		if s.buffer.Len()+len(rpc.Payload) > StreamWindow {
+			return fmt.Errorf("stream (%d) exceeded its window", s.id)
+		}
+		s.buffer.Write(rpc.Payload)
+
+	case TypeStreamWindow:
+		grant, n := binary.Uvarint(rpc.Payload)
+		if n <= 0 {
+			return fmt.Errorf("stream (%d) got an invalid window update", s.id)
+		}
+		s.sendWindow += uint32(grant)
+
+	case TypeStreamClose:
+		s.remoteClosed = true
+		if s.localClosed {
+			s.peer.removeStream(s.id)
+		}
+	}
+
+	return nil
+}
+
+// fail wakes up everyone waiting on the stream once the connection is gone
+func (s *stream) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.err = err
+	s.cond.Broadcast()
+}
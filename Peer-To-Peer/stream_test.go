@@ -0,0 +1,125 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connectedPeers returns both ends of a connection between two transports
+func connectedPeers(t *testing.T, listenAddress string) (Peer, Peer) {
+	return connectedPeersWith(t, TCPTransportConfig{ListenAddress: listenAddress})
+}
+
+// connectedPeersWith connects two transports with the given configuration
+func connectedPeersWith(t *testing.T, config TCPTransportConfig) (Peer, Peer) {
+	listenAddress := config.ListenAddress
+	peers := make(chan Peer, 2)
+	config.HandshakeFunc = NOPHandshakeFunc
+	config.PeerStatus = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+
+	server := NewTCPTransport(config)
+	assert.Nil(t, server.ListenAndAccept())
+	t.Cleanup(func() { server.Close() })
+
+	config.ListenAddress = ""
+	client := NewTCPTransport(config)
+	assert.Nil(t, client.Dial(listenAddress))
+
+	return <-peers, <-peers
+}
+
+func TestStreamMultiplexing(t *testing.T) {
+	local, remote := connectedPeers(t, ":9100")
+
+	// more data per stream than fits in a window, on several streams at once
+	const streams = 4
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 3*StreamWindow)
+
+		s, err := local.OpenStream()
+		assert.Nil(t, err)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := s.Write(data)
+			assert.Nil(t, err)
+			assert.Nil(t, s.Close())
+		}()
+		go func(id uint32) {
+			defer wg.Done()
+			rs, err := remote.AcceptStream(id)
+			assert.Nil(t, err)
+
+			b, err := io.ReadAll(rs)
+			assert.Nil(t, err)
+			assert.Equal(t, data, b)
+			assert.Nil(t, rs.Close())
+		}(s.ID())
+	}
+	wg.Wait()
+}
+
+func TestStreamClosedByReceiver(t *testing.T) {
+	local, remote := connectedPeers(t, ":9101")
+
+	s, err := local.OpenStream()
+	assert.Nil(t, err)
+
+	rs, err := remote.AcceptStream(s.ID())
+	assert.Nil(t, err)
+	assert.Nil(t, rs.Close())
+
+	// the sender gives up once the receiver walked away
+	_, err = s.Write(make([]byte, 4*StreamWindow))
+	assert.ErrorIs(t, err, ErrStreamClosed)
+}
+
+func TestStreamNotAccepted(t *testing.T) {
+	local, remote := connectedPeersWith(t, TCPTransportConfig{
+		ListenAddress:        ":9102",
+		MaxPendingStreams:    1,
+		PendingStreamTimeout: 100 * time.Millisecond,
+	})
+
+	pending, err := local.OpenStream()
+	assert.Nil(t, err)
+	_, err = pending.Write([]byte("waiting"))
+	assert.Nil(t, err)
+
+	// a second stream exceeds the pending streams and is closed straight away
+	s, err := local.OpenStream()
+	assert.Nil(t, err)
+	_, err = s.Write(make([]byte, 4*StreamWindow))
+	assert.ErrorIs(t, err, ErrStreamClosed)
+
+	// the first one is closed once it waited too long
+	time.Sleep(200 * time.Millisecond)
+	_, err = remote.AcceptStream(pending.ID())
+	assert.ErrorIs(t, err, ErrStreamClosed)
+	_, err = pending.Write(make([]byte, 4*StreamWindow))
+	assert.ErrorIs(t, err, ErrStreamClosed)
+
+	// which makes room for the next stream
+	s, err = local.OpenStream()
+	assert.Nil(t, err)
+	go func() {
+		s.Write([]byte("accepted"))
+		s.Close()
+	}()
+
+	rs, err := remote.AcceptStream(s.ID())
+	assert.Nil(t, err)
+	b, err := io.ReadAll(rs)
+	assert.Nil(t, err)
+	assert.Equal(t, "accepted", string(b))
+}
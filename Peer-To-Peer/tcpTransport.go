@@ -1,13 +1,31 @@
 package p2p
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
+const (
+	// defining how long the accept loop waits after a failed accept,
+	// doubling up to the maximum while the failures go on
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+
+	// defining how many streams opened by a peer may wait to be accepted
+	// and how long each of them waits before it is closed
+	DefaultMaxPendingStreams    = 64
+	DefaultPendingStreamTimeout = 30 * time.Second
+)
+
+// ErrTooManyConnections is returned when an accepted connection
+// would exceed MaxInboundConns or MaxConnsPerIP
+var ErrTooManyConnections = errors.New("too many connections")
+
 // TCPPeer represents the remote node in established TCP connection
 type TCPPeer struct {
 
@@ -17,35 +35,285 @@ type TCPPeer struct {
 	// if we dial and retrieve a connection => outbound == true
 	// if we accept and retrieve a connection => outbound == false
 	outbound bool
-	wg *sync.WaitGroup
+
+	// info describes the remote node as established by the handshake
+	info NodeInfo
+
+	// encoder frames everything sent to the peer. Writes to a TLS connection
+	// are not atomic, so lockWrite keeps frames sent concurrently from interleaving.
+	encoder   Encoder
+	lockWrite sync.Mutex
+
+	// streams multiplexed over the connection, keyed by stream ID.
+	// Streams we open get odd IDs if we dialed and even IDs if we accepted,
+	// so both ends can open streams without agreeing on IDs first.
+	lockStreams  sync.Mutex
+	streams      map[uint32]*stream
+	nextStreamID uint32
+	streamsErr   error
+
+	// streams the peer sent frames on which were not accepted yet, each closed
+	// by its timer unless accepted in time, and those which were closed that way.
+	// A closed stream stays known until the peer closes it too,
+	// so its late frames do not open it again.
+	pending              map[uint32]*time.Timer
+	rejected             map[uint32]bool
+	maxPendingStreams    int
+	pendingStreamTimeout time.Duration
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 
+	nextStreamID := uint32(2)
+	if outbound {
+		nextStreamID = 1
+	}
+
 	return &TCPPeer{
-		Conn: conn,
-		outbound:   outbound,
-		wg: &sync.WaitGroup{},
+		Conn:                 conn,
+		outbound:             outbound,
+		encoder:              FrameEncoder{},
+		streams:              make(map[uint32]*stream),
+		nextStreamID:         nextStreamID,
+		pending:              make(map[uint32]*time.Timer),
+		rejected:             make(map[uint32]bool),
+		maxPendingStreams:    DefaultMaxPendingStreams,
+		pendingStreamTimeout: DefaultPendingStreamTimeout,
 	}
 }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// ID returns the identity of the remote node established by the handshake,
+// or its remote address if the handshake did not establish one
+func (p *TCPPeer) ID() string {
+	if len(p.info.ID) == 0 {
+		return p.RemoteAddr().String()
+	}
+	return p.info.ID
+}
+
+// Info returns what the handshake learned about the remote node
+func (p *TCPPeer) Info() NodeInfo {
+	info := p.info
+	info.ID = p.ID()
+	return info
+}
+
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
 }
+
+// Send writes data to the peer as a single message
 func (p *TCPPeer) Send(data []byte) error {
-	_, err := p.Conn.Write(data)
-	return err
+	return p.encode(&RPC{Payload: data})
+}
+
+// encode writes a single frame to the connection
+func (p *TCPPeer) encode(rpc *RPC) error {
+	p.lockWrite.Lock()
+	defer p.lockWrite.Unlock()
+
+	return p.encoder.Encode(p.Conn, rpc)
 }
+
+// OpenStream starts a new stream to the peer. The peer gets hold of it
+// through AcceptStream once it is told the ID of the stream.
+func (p *TCPPeer) OpenStream() (Stream, error) {
+	p.lockStreams.Lock()
+	defer p.lockStreams.Unlock()
+
+	if p.streamsErr != nil {
+		return nil, p.streamsErr
+	}
+
+	id := p.nextStreamID
+	p.nextStreamID += 2
+
+	s := newStream(id, p)
+	p.streams[id] = s
+	return s, nil
+}
+
+// AcceptStream returns the stream with the given ID opened by the peer.
+// It may be called before or after the first data of the stream arrived.
+func (p *TCPPeer) AcceptStream(id uint32) (Stream, error) {
+	if p.ownsStreamID(id) {
+		return nil, fmt.Errorf("stream (%d) was not opened by the peer", id)
+	}
+
+	p.lockStreams.Lock()
+	defer p.lockStreams.Unlock()
+
+	if p.streamsErr != nil {
+		return nil, p.streamsErr
+	}
+	if p.rejected[id] {
+		return nil, fmt.Errorf("stream (%d) was not accepted in time: %w", id, ErrStreamClosed)
+	}
+
+	if timer, ok := p.pending[id]; ok {
+		timer.Stop()
+		delete(p.pending, id)
+	}
+
+	s, ok := p.streams[id]
+	if !ok {
+		s = newStream(id, p)
+		p.streams[id] = s
+	}
+	return s, nil
+}
+
+func (p *TCPPeer) ownsStreamID(id uint32) bool {
+	return (id%2 == 1) == p.outbound
+}
+
+// remoteStream looks up a stream opened by the peer for a frame received on it.
+// A stream not known yet is pending until accepted, unless too many are pending already.
+// It returns nil for frames which are dropped.
+func (p *TCPPeer) remoteStream(rpc *RPC) (*stream, error) {
+	p.lockStreams.Lock()
+	defer p.lockStreams.Unlock()
+
+	if p.streamsErr != nil {
+		return nil, p.streamsErr
+	}
+
+	id := rpc.StreamID
+	if p.rejected[id] {
+		if rpc.Type == TypeStreamClose {
+			delete(p.rejected, id)
+		}
+		return nil, nil
+	}
+
+	s, ok := p.streams[id]
+	if ok {
+		return s, nil
+	}
+
+	if len(p.pending) >= p.maxPendingStreams {
+		p.rejected[id] = true
+
+		// the read loop does not wait for the write
+		go p.sendStreamFrame(TypeStreamClose, id, nil)
+		return nil, nil
+	}
+
+	s = newStream(id, p)
+	p.streams[id] = s
+	p.pending[id] = time.AfterFunc(p.pendingStreamTimeout, func() { p.expireStream(id) })
+	return s, nil
+}
+
+// expireStream closes a stream which was not accepted in time
+func (p *TCPPeer) expireStream(id uint32) {
+	p.lockStreams.Lock()
+	if _, ok := p.pending[id]; !ok {
+		p.lockStreams.Unlock()
+		return
+	}
+	delete(p.pending, id)
+	s := p.streams[id]
+	delete(p.streams, id)
+	p.rejected[id] = true
+	p.lockStreams.Unlock()
+
+	// a stream the peer closed already gets no more frames
+	s.lock.Lock()
+	remoteClosed := s.remoteClosed
+	s.lock.Unlock()
+	if remoteClosed {
+		p.lockStreams.Lock()
+		delete(p.rejected, id)
+		p.lockStreams.Unlock()
+	}
+
+	p.sendStreamFrame(TypeStreamClose, id, nil)
+}
+
+func (p *TCPPeer) removeStream(id uint32) {
+	p.lockStreams.Lock()
+	defer p.lockStreams.Unlock()
+
+	delete(p.streams, id)
+}
+
+func (p *TCPPeer) sendStreamFrame(frameType byte, id uint32, payload []byte) error {
+	return p.encode(&RPC{
+		Payload:  payload,
+		Stream:   true,
+		Type:     frameType,
+		StreamID: id,
+	})
+}
+
+// handleStreamFrame routes a frame from the read loop to its stream
+func (p *TCPPeer) handleStreamFrame(rpc *RPC) error {
+	// frames for a stream we opened, which is already gone, are late and dropped
+	if p.ownsStreamID(rpc.StreamID) {
+		p.lockStreams.Lock()
+		s, ok := p.streams[rpc.StreamID]
+		p.lockStreams.Unlock()
+
+		if !ok {
+			return nil
+		}
+		return s.handleFrame(rpc)
+	}
+
+	s, err := p.remoteStream(rpc)
+	if s == nil || err != nil {
+		return err
+	}
+	return s.handleFrame(rpc)
+}
+
+// closeStreams fails every stream once the connection is gone
+func (p *TCPPeer) closeStreams(err error) {
+	p.lockStreams.Lock()
+	p.streamsErr = err
+	streams := make([]*stream, 0, len(p.streams))
+	for _, s := range p.streams {
+		streams = append(streams, s)
+	}
+	p.streams = make(map[uint32]*stream)
+	for _, timer := range p.pending {
+		timer.Stop()
+	}
+	p.pending = make(map[uint32]*time.Timer)
+	p.lockStreams.Unlock()
+
+	for _, s := range streams {
+		s.fail(err)
+	}
+}
+
 // This struct type defines the configuration for a particular transport.
 // ListenAddress -> The address of the transport to connect to.
 // HandSHakeFunc -> For initiating Handshake as we see in a TCP model.
-// Decoder -> The type of decoder to use based on the transport.
+// Decoder -> The type of decoder to use based on the transport, FrameDecoder if nil.
+// Encoder -> The encoder matching the Decoder, FrameEncoder if nil.
 // PeerStatus -> If the func returns an error we drop the peer.
+// PeerDisconnect -> Called once a peer accepted by PeerStatus is dropped.
+// TLSConfig -> If set, every connection is made over TLS with this configuration.
+// MaxInboundConns -> Accepted connections served at once, unlimited if 0.
+// MaxConnsPerIP -> Accepted connections from a single IP served at once, unlimited if 0.
+// MaxPendingStreams -> Streams of a peer waiting to be accepted, DefaultMaxPendingStreams if 0.
+// PendingStreamTimeout -> How long a stream waits to be accepted, DefaultPendingStreamTimeout if 0.
 type TCPTransportConfig struct {
-	ListenAddress string
-	HandshakeFunc HandshakeFunc
-	Decoder       Decoder
-	PeerStatus    func(Peer) error
+	ListenAddress  string
+	HandshakeFunc  HandshakeFunc
+	Decoder        Decoder
+	Encoder        Encoder
+	PeerStatus     func(Peer) error
+	PeerDisconnect func(Peer)
+	TLSConfig      *tls.Config
+
+	MaxInboundConns int
+	MaxConnsPerIP   int
+
+	MaxPendingStreams    int
+	PendingStreamTimeout time.Duration
 }
 
 // Transmission Control Protocol
@@ -53,17 +321,43 @@ type TCPTransport struct {
 	TCPTransportConfig
 	listener   net.Listener
 	rpcChannel chan RPC
+
+	// every connection being served, so Close can drop them,
+	// and the number of accepted ones in total and by remote IP
+	lockConns    sync.Mutex
+	conns        map[net.Conn]struct{}
+	inbound      int
+	inboundByIP  map[string]int
+	closed       bool
+	closeChannel chan struct{}
+	acceptDone   sync.WaitGroup
 }
 
 func NewTCPTransport(config TCPTransportConfig) *TCPTransport {
+	if config.Decoder == nil {
+		config.Decoder = FrameDecoder{}
+	}
+	if config.Encoder == nil {
+		config.Encoder = FrameEncoder{}
+	}
+	if config.MaxPendingStreams <= 0 {
+		config.MaxPendingStreams = DefaultMaxPendingStreams
+	}
+	if config.PendingStreamTimeout <= 0 {
+		config.PendingStreamTimeout = DefaultPendingStreamTimeout
+	}
+
 	return &TCPTransport{
 		TCPTransportConfig: config,
 		rpcChannel:         make(chan RPC),
+		conns:              make(map[net.Conn]struct{}),
+		inboundByIP:        make(map[string]int),
+		closeChannel:       make(chan struct{}),
 	}
 }
 
 // Addr implements transport interface which will return the address of the transport
-func (t * TCPTransport) Addr() string {
+func (t *TCPTransport) Addr() string {
 	return t.ListenAddress
 }
 
@@ -73,21 +367,117 @@ func (t *TCPTransport) Consume() <-chan RPC {
 	return t.rpcChannel
 }
 
+// Close stops accepting connections and drops every connection being served
 func (t *TCPTransport) Close() error {
-	return t.listener.Close()
+	t.lockConns.Lock()
+	if t.closed {
+		t.lockConns.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.closeChannel)
+
+	listener := t.listener
+	conns := make([]net.Conn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.lockConns.Unlock()
+
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	t.acceptDone.Wait()
+	return err
+}
+
+// track registers a connection to be served.
+// Accepted connections are counted against the inbound limits.
+func (t *TCPTransport) track(conn net.Conn, inbound bool) error {
+	t.lockConns.Lock()
+	defer t.lockConns.Unlock()
+
+	if t.closed {
+		return net.ErrClosed
+	}
+
+	if inbound {
+		ip := remoteIP(conn)
+		if t.MaxInboundConns > 0 && t.inbound >= t.MaxInboundConns {
+			return fmt.Errorf("%w: %d inbound connections", ErrTooManyConnections, t.inbound)
+		}
+		if t.MaxConnsPerIP > 0 && t.inboundByIP[ip] >= t.MaxConnsPerIP {
+			return fmt.Errorf("%w: %d inbound connections from %s", ErrTooManyConnections, t.inboundByIP[ip], ip)
+		}
+		t.inbound++
+		t.inboundByIP[ip]++
+	}
+
+	t.conns[conn] = struct{}{}
+	return nil
+}
+
+func (t *TCPTransport) untrack(conn net.Conn, inbound bool) {
+	t.lockConns.Lock()
+	defer t.lockConns.Unlock()
+
+	if _, ok := t.conns[conn]; !ok {
+		return
+	}
+	delete(t.conns, conn)
+
+	if inbound {
+		ip := remoteIP(conn)
+		t.inbound--
+		if t.inboundByIP[ip]--; t.inboundByIP[ip] == 0 {
+			delete(t.inboundByIP, ip)
+		}
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
 }
 
 func (t *TCPTransport) Dial(address string) error {
-	conn, err := net.Dial("tcp", address)
+	select {
+	case <-t.closeChannel:
+		return net.ErrClosed
+	default:
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if t.TLSConfig != nil {
+		conn, err = tls.Dial("tcp", address, t.TLSConfig)
+	} else {
+		conn, err = net.Dial("tcp", address)
+	}
 	if err != nil {
 		return err
 	}
 
-	go t.handleConnection(conn, true) // because we are dialing: outbound -> true
+	if err := t.track(conn, false); err != nil {
+		conn.Close()
+		return err
+	}
+
+	go t.handleConnection(conn, address) // because we are dialing: outbound -> true
 	return nil
 }
 
-
 func (t *TCPTransport) ListenAndAccept() error {
 
 	listener, err := net.Listen("tcp", t.ListenAddress)
@@ -95,43 +485,92 @@ func (t *TCPTransport) ListenAndAccept() error {
 		return err
 	}
 
+	if t.TLSConfig != nil {
+		listener = tls.NewListener(listener, t.TLSConfig)
+	}
+
 	//Accept part
+	t.lockConns.Lock()
+	if t.closed {
+		t.lockConns.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
 	t.listener = listener
+	t.acceptDone.Add(1)
+	t.lockConns.Unlock()
+
 	go t.acceptLoop()
 
 	log.Printf("TCP transport listening on: %s\n", t.ListenAddress)
 	return nil
 }
 
-// private func for accept loop
+// acceptLoop serves every accepted connection until the listener is closed
 func (t *TCPTransport) acceptLoop() {
+	defer t.acceptDone.Done()
 
-	// is for loop necessary?
-	conn, err := t.listener.Accept()
+	var delay time.Duration
+	for {
+		conn, err := t.listener.Accept()
 
-	// If the connection is closed, we return
-	if errors.Is(err, net.ErrClosed) {
-		return
-	}
-	if err != nil {
-		fmt.Println("TCP Connection Error")
-	}
+		// If the listener is closed, we return
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 
-	go t.handleConnection(conn, false) // because we are accepting the connection
+		// failures such as running out of file descriptors may pass,
+		// so instead of giving up we retry after a growing delay
+		if err != nil {
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			fmt.Printf("TCP Accept Error: %s, retrying in %s\n", err, delay)
+
+			select {
+			case <-time.After(delay):
+				continue
+			case <-t.closeChannel:
+				return
+			}
+		}
+		delay = 0
+
+		if err := t.track(conn, true); err != nil {
+			fmt.Printf("TCP Connection from %s refused: %s\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+
+		go t.handleConnection(conn, "") // because we are accepting the connection
+	}
 }
 
-func (t *TCPTransport) handleConnection(conn net.Conn, outbound bool) {
-	var err error
+// handleConnection serves a connection until it fails.
+// dialed is the address we dialed to get it, empty for an accepted connection.
+func (t *TCPTransport) handleConnection(conn net.Conn, dialed string) {
+	var (
+		err       error
+		connected bool
+	)
+
+	peer := NewTCPPeer(conn, len(dialed) > 0)
+	peer.encoder = t.Encoder
+	peer.maxPendingStreams = t.MaxPendingStreams
+	peer.pendingStreamTimeout = t.PendingStreamTimeout
+	peer.info.ListenAddr = dialed
 
 	// after generating any kind of error the handleConnection function exits
 	// then defer is called which drops the peer connection
 	// this is true for any error
 	defer func() {
-		fmt.Printf("dropping peer connection: %+v", err)
+		fmt.Printf("dropping peer connection: %+v\n", err)
+		peer.closeStreams(fmt.Errorf("connection to %s dropped: %w", conn.RemoteAddr(), net.ErrClosed))
 		conn.Close()
-	}()
+		t.untrack(conn, !peer.outbound)
 
-	peer := NewTCPPeer(conn, outbound)
+		if connected && t.PeerDisconnect != nil {
+			t.PeerDisconnect(peer)
+		}
+	}()
 	if err := t.HandshakeFunc(peer); err != nil {
 		conn.Close()
 		fmt.Printf("TCP Handshake Error: %s\n", err)
@@ -145,26 +584,44 @@ func (t *TCPTransport) handleConnection(conn net.Conn, outbound bool) {
 			return
 		}
 	}
+	connected = true
 
 	//Reading the connection loop after the handshake and if peerStatus doesnt fail
+	// the payload of a stream frame is copied by its stream,
+	// so its buffer is reused for the frames after it
+	var buffer []byte
+	from := peer.ID()
 	for {
-		rpc := RPC{}
-		if err := t.Decoder.Decode(conn, &rpc); err != nil {
+		rpc := RPC{Payload: buffer[:0]}
+		if err = t.Decoder.Decode(conn, &rpc); err != nil {
 			fmt.Printf("TCP Decoding Error: %s\n", err)
-			continue
+
+			// an oversized frame was skipped, anything else leaves the connection unusable
+			if errors.Is(err, ErrFrameTooLarge) {
+				continue
+			}
+			return
 		}
 
-		rpc.From = conn.RemoteAddr().String()
+		rpc.From = from
 
+		// Frames of a stream go straight to the stream, which buffers them,
+		// so the connection keeps being read while any stream is in flight
 		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] Stream Detected\n", rpc.From)
-			peer.wg.Wait()
-			fmt.Printf("[%s] Stream Closed\n", rpc.From)
+			if err = peer.handleStreamFrame(&rpc); err != nil {
+				return
+			}
+			buffer = rpc.Payload
 			continue
 		}
-		
-		t.rpcChannel <- rpc
-		
+
+		buffer = nil
+
+		// nobody consumes messages after Close, the connection is dropped instead
+		select {
+		case t.rpcChannel <- rpc:
+		case <-t.closeChannel:
+			return
+		}
 	}
 }
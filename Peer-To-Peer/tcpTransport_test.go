@@ -1,7 +1,11 @@
 package p2p
 
 import (
+	"errors"
+	"io"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -11,7 +15,7 @@ func TestTCPTransport(t *testing.T) {
 	tcpConfig := TCPTransportConfig{
 		ListenAddress: ":9000",
 		HandshakeFunc: NOPHandshakeFunc,
-		Decoder:       DefaultDecoder{},
+		Decoder:       FrameDecoder{},
 	}
 
 	transport := NewTCPTransport(tcpConfig)
@@ -21,3 +25,90 @@ func TestTCPTransport(t *testing.T) {
 	//Server
 	assert.Nil(t, transport.ListenAndAccept())
 }
+
+// dropped reports whether the transport on the other end closed conn
+func dropped(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	return errors.Is(err, io.EOF)
+}
+
+func TestTCPTransportAcceptLimits(t *testing.T) {
+	for name, config := range map[string]TCPTransportConfig{
+		"inbound": {ListenAddress: ":9130", MaxInboundConns: 2},
+		"per IP":  {ListenAddress: ":9131", MaxConnsPerIP: 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config.HandshakeFunc = NOPHandshakeFunc
+			transport := NewTCPTransport(config)
+			assert.Nil(t, transport.ListenAndAccept())
+			defer transport.Close()
+
+			var conns []net.Conn
+			for i := 0; i < 3; i++ {
+				conn, err := net.Dial("tcp", config.ListenAddress)
+				assert.Nil(t, err)
+				defer conn.Close()
+				conns = append(conns, conn)
+			}
+
+			assert.False(t, dropped(conns[0]))
+			assert.False(t, dropped(conns[1]))
+			assert.True(t, dropped(conns[2]))
+
+			// the freed slot is served again
+			conns[0].Close()
+			time.Sleep(50 * time.Millisecond)
+
+			conn, err := net.Dial("tcp", config.ListenAddress)
+			assert.Nil(t, err)
+			defer conn.Close()
+			assert.False(t, dropped(conn))
+		})
+	}
+}
+
+func TestTCPTransportClose(t *testing.T) {
+	transport := NewTCPTransport(TCPTransportConfig{
+		ListenAddress: ":9132",
+		HandshakeFunc: NOPHandshakeFunc,
+	})
+	assert.Nil(t, transport.ListenAndAccept())
+
+	conn, err := net.Dial("tcp", ":9132")
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.False(t, dropped(conn))
+
+	assert.Nil(t, transport.Close())
+	assert.True(t, dropped(conn))
+
+	_, err = net.Dial("tcp", ":9132")
+	assert.NotNil(t, err)
+	assert.ErrorIs(t, transport.Dial(":9132"), net.ErrClosed)
+}
+
+func TestTCPTransportCloseUnconsumed(t *testing.T) {
+	disconnected := make(chan Peer, 1)
+	transport := NewTCPTransport(TCPTransportConfig{
+		ListenAddress:  ":9134",
+		HandshakeFunc:  NOPHandshakeFunc,
+		PeerDisconnect: func(p Peer) { disconnected <- p },
+	})
+	assert.Nil(t, transport.ListenAndAccept())
+
+	conn, err := net.Dial("tcp", ":9134")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// nobody consumes the message, yet the connection is dropped on Close
+	assert.Nil(t, FrameEncoder{}.Encode(conn, &RPC{Payload: []byte("unread")}))
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, transport.Close())
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("expected the peer to be dropped after Close")
+	}
+}
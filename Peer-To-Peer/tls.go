@@ -0,0 +1,100 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// ErrNoPeerCertificate is returned when the peer did not present a certificate
+var ErrNoPeerCertificate = errors.New("peer presented no certificate")
+
+// NewMutualTLSConfig returns a TLS configuration for a node which presents
+// cert to its peers and only talks to peers whose certificate is signed by a CA in caPool.
+// The same configuration is used for listening and for dialing.
+//
+// Nodes are addressed by listen address and not by host name, so instead of
+// the host name check of TLS, the certificate chain of the peer is verified
+// against caPool on both ends and the node identity is taken from the
+// certificate by TLSHandshakeFunc.
+func NewMutualTLSConfig(cert tls.Certificate, caPool *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+
+		// the chain is verified by VerifyConnection instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyPeerCertificate(cs.PeerCertificates, caPool)
+		},
+	}
+}
+
+func verifyPeerCertificate(certs []*x509.Certificate, caPool *x509.CertPool) error {
+	if len(certs) == 0 {
+		return ErrNoPeerCertificate
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         caPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// CertificateIdentity maps the certificate of a peer to its node identity
+type CertificateIdentity func(*x509.Certificate) (string, error)
+
+// CommonNameIdentity uses the common name of the certificate as node identity
+func CommonNameIdentity(cert *x509.Certificate) (string, error) {
+	if len(cert.Subject.CommonName) == 0 {
+		return "", fmt.Errorf("certificate (%s) has no common name", cert.SerialNumber)
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// TLSHandshakeFunc completes the TLS handshake with the peer
+// and sets the identity of the peer from its certificate.
+// If identity is nil, CommonNameIdentity is used.
+func TLSHandshakeFunc(identity CertificateIdentity) HandshakeFunc {
+	if identity == nil {
+		identity = CommonNameIdentity
+	}
+
+	return func(peer Peer) error {
+		p, ok := peer.(*TCPPeer)
+		if !ok {
+			return fmt.Errorf("unsupported peer type %T", peer)
+		}
+
+		conn, ok := p.Conn.(*tls.Conn)
+		if !ok {
+			return fmt.Errorf("connection to %s is not using TLS", p.RemoteAddr())
+		}
+
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+
+		certs := conn.ConnectionState().PeerCertificates
+		if len(certs) == 0 {
+			return ErrNoPeerCertificate
+		}
+
+		id, err := identity(certs[0])
+		if err != nil {
+			return err
+		}
+
+		p.info.ID = id
+		return nil
+	}
+}
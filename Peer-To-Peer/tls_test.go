@@ -0,0 +1,165 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA signs node certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTLSTransport(listenAddress string, config *tls.Config, peers chan Peer) *TCPTransport {
+	return NewTCPTransport(TCPTransportConfig{
+		ListenAddress: listenAddress,
+		HandshakeFunc: TLSHandshakeFunc(nil),
+		TLSConfig:     config,
+		PeerStatus: func(p Peer) error {
+			peers <- p
+			return nil
+		},
+	})
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	peers := make(chan Peer, 2)
+
+	server := newTLSTransport(":9110", NewMutualTLSConfig(ca.issue(t, "node-a"), ca.pool), peers)
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	client := newTLSTransport("", NewMutualTLSConfig(ca.issue(t, "node-b"), ca.pool), peers)
+	assert.Nil(t, client.Dial(":9110"))
+
+	ids := []string{(<-peers).ID(), (<-peers).ID()}
+	assert.ElementsMatch(t, []string{"node-a", "node-b"}, ids)
+}
+
+func TestConcurrentSendTLS(t *testing.T) {
+	ca := newTestCA(t)
+	peers := make(chan Peer, 2)
+
+	server := newTLSTransport(":9133", NewMutualTLSConfig(ca.issue(t, "node-a"), ca.pool), peers)
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	client := newTLSTransport("", NewMutualTLSConfig(ca.issue(t, "node-b"), ca.pool), peers)
+	assert.Nil(t, client.Dial(":9133"))
+	defer client.Close()
+
+	var sender Peer
+	for i := 0; i < 2; i++ {
+		if p := <-peers; p.ID() == "node-a" {
+			sender = p
+		}
+	}
+
+	// each frame spans several TLS records, which a concurrent frame could split
+	const senders, frames, size = 64, 4, 64 << 10
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(b byte) {
+			defer wg.Done()
+			for j := 0; j < frames; j++ {
+				assert.Nil(t, sender.Send(bytes.Repeat([]byte{b}, size)))
+			}
+		}(byte(i))
+	}
+	defer wg.Wait()
+
+	received := make(map[byte]int)
+	for i := 0; i < senders*frames; i++ {
+		select {
+		case rpc := <-server.Consume():
+			if !assert.Len(t, rpc.Payload, size) {
+				return
+			}
+			assert.Equal(t, bytes.Repeat(rpc.Payload[:1], size), rpc.Payload)
+			received[rpc.Payload[0]]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d frames", i, senders*frames)
+		}
+	}
+	assert.Len(t, received, senders)
+}
+
+func TestMutualTLSUnknownCA(t *testing.T) {
+	ca, stranger := newTestCA(t), newTestCA(t)
+	serverPeers, clientPeers := make(chan Peer, 1), make(chan Peer, 1)
+
+	server := newTLSTransport(":9111", NewMutualTLSConfig(ca.issue(t, "node-a"), ca.pool), serverPeers)
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	// the stranger trusts the server, but the server does not trust the stranger
+	strangerPool := stranger.pool.Clone()
+	strangerPool.AddCert(ca.cert)
+	client := newTLSTransport("", NewMutualTLSConfig(stranger.issue(t, "node-b"), strangerPool), clientPeers)
+	client.Dial(":9111")
+
+	select {
+	case p := <-serverPeers:
+		t.Errorf("expected no peer, but %s connected", p.ID())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -1,12 +1,30 @@
 package p2p
 
-import "net"
+import (
+	"io"
+	"net"
+)
 
 // Peer is a remote node
 type Peer interface {
 	net.Conn
+
+	// ID is the identity of the remote node
+	ID() string
+	Info() NodeInfo
+
+	// Outbound is true if we dialed the peer, false if it dialed us
+	Outbound() bool
 	Send([]byte) error
-	CloseStream()
+	OpenStream() (Stream, error)
+	AcceptStream(id uint32) (Stream, error)
+}
+
+// Stream is one of the many independent streams
+// multiplexed over the connection to a peer
+type Stream interface {
+	io.ReadWriteCloser
+	ID() uint32
 }
 
 // Tranport handles the communication between nodes.
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	p2p "github.com/palSagnik/Distributed-File-Storage/Peer-To-Peer"
+)
+
+const (
+	// defining how often a node compares its replicas with every peer
+	defaultAntiEntropyInterval = time.Minute
+
+	// defining how many bytes of records a MessageSyncTreeResponse carries,
+	// well below the largest frame a peer accepts
+	maxSyncRecordBytes = p2p.DefaultMaxFrameSize / 4
+)
+
+// MessageSyncTree summarises the replicas the sender holds
+// which the receiver owns as well
+type MessageSyncTree struct {
+	RequestID string
+	Tree      merkleTree
+}
+
+// MessageSyncTreeResponse lists the buckets where the summaries differ
+// and the records of the replicas the peer holds in them, sorted by the key
+// of their replicas. More is set if the records did not fit in the response,
+// the ones following the last of them are asked for with MessageSyncRecords.
+type MessageSyncTreeResponse struct {
+	RequestID string
+	Buckets   []int
+	Records   []Record
+	More      bool
+}
+
+// MessageSyncRecords asks for the records of the replicas in Buckets
+// following the key of the replica After, answered by MessageSyncTreeResponse
+type MessageSyncRecords struct {
+	RequestID string
+	Buckets   []int
+	After     string
+}
+
+// AntiEntropyStats counts the work done by the anti-entropy process
+type AntiEntropyStats struct {
+	// Rounds is the number of times every peer was compared with
+	Rounds uint64
+
+	// Repairs is the number of replicas sent to peers which were
+	// missing them or held an older version, Failures of those which failed
+	Repairs  uint64
+	Failures uint64
+}
+
+type antiEntropyCounters struct {
+	rounds   atomic.Uint64
+	repairs  atomic.Uint64
+	failures atomic.Uint64
+}
+
+func (fs *FileServer) AntiEntropyStats() AntiEntropyStats {
+	return AntiEntropyStats{
+		Rounds:   fs.antiEntropyCounters.rounds.Load(),
+		Repairs:  fs.antiEntropyCounters.repairs.Load(),
+		Failures: fs.antiEntropyCounters.failures.Load(),
+	}
+}
+
+// antiEntropy compares the replicas of this node with every peer
+// once per AntiEntropyInterval until Stop
+func (fs *FileServer) antiEntropy() {
+	ticker := time.NewTicker(fs.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fs.antiEntropyRound(fs.ctx)
+		case <-fs.quitChannel:
+			return
+		}
+	}
+}
+
+func (fs *FileServer) antiEntropyRound(ctx context.Context) {
+	fs.lockPeer.Lock()
+	peers := make([]p2p.Peer, 0, len(fs.peers))
+	for _, peer := range fs.peers {
+		peers = append(peers, peer)
+	}
+	fs.lockPeer.Unlock()
+
+	for _, peer := range peers {
+		if err := fs.syncPeer(ctx, peer); err != nil {
+			log.Printf("[%s] Anti-entropy with %s: %s", fs.Transport.Addr(), peer.ID(), err)
+		}
+	}
+	fs.antiEntropyCounters.rounds.Add(1)
+}
+
+// sharedReplicas returns the records of the replicas this node holds
+// which the node id owns. A file written by this node counts as the replica
+// stored under its hashed key and a tombstone as the replica it replaced,
+// only the newest of them is returned for every key.
+func (fs *FileServer) sharedReplicas(id string) ([]Record, error) {
+	records, err := fs.storage.Records(fs.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	newest := make(map[string]Record)
+	for _, record := range records {
+		key := record.replicaKey()
+		if !fs.owns(id, key) {
+			continue
+		}
+		if kept, ok := newest[key]; ok && kept.Version >= record.Version {
+			continue
+		}
+		newest[key] = record
+	}
+
+	shared := make([]Record, 0, len(newest))
+	for _, record := range newest {
+		shared = append(shared, record)
+	}
+	return shared, nil
+}
+
+// syncPeer sends the peer the replicas it is missing or holds an older version of,
+// and the tombstones of those deleted since.
+// Replicas the peer holds newer versions of reach this node when the peer syncs with it.
+func (fs *FileServer) syncPeer(ctx context.Context, peer p2p.Peer) error {
+	shared, err := fs.sharedReplicas(peer.ID())
+	if err != nil {
+		return err
+	}
+
+	records, err := fs.outdated(ctx, peer, shared)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		err := fs.replicate(ctx, peer, record)
+
+		// the peer got a newer version since it summarised its replicas
+		if errors.Is(err, ErrOutdated) {
+			continue
+		}
+		if err != nil {
+			fs.antiEntropyCounters.failures.Add(1)
+			log.Printf("[%s] Repairing (%s) on %s: %s", fs.Transport.Addr(), record.Key, peer.ID(), err)
+			continue
+		}
+		fs.antiEntropyCounters.repairs.Add(1)
+		fmt.Printf("[%s] Repaired (%s) on %s\n", fs.Transport.Addr(), record.Key, peer.ID())
+	}
+
+	return nil
+}
+
+// outdated compares the replicas shared with the peer by sharedReplicas with the peer
+// and returns those it is missing or holds an older version of
+func (fs *FileServer) outdated(ctx context.Context, peer p2p.Peer, records []Record) ([]Record, error) {
+	res, err := fs.request(ctx, peer, func(requestID string) any {
+		return MessageSyncTree{RequestID: requestID, Tree: *newMerkleTree(records)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, ok := res.(MessageSyncTreeResponse)
+	if !ok {
+		return nil, fs.unexpected(peer.ID(), res)
+	}
+
+	differing := make(map[int]bool, len(payload.Buckets))
+	for _, bucket := range payload.Buckets {
+		differing[bucket] = true
+	}
+
+	theirs := make(map[string]Record, len(payload.Records))
+	for {
+		for _, record := range payload.Records {
+			theirs[record.replicaKey()] = record
+		}
+		if !payload.More || len(payload.Records) == 0 {
+			break
+		}
+
+		after := payload.Records[len(payload.Records)-1].replicaKey()
+		res, err := fs.request(ctx, peer, func(requestID string) any {
+			return MessageSyncRecords{RequestID: requestID, Buckets: payload.Buckets, After: after}
+		})
+		if err != nil {
+			return nil, err
+		}
+		if payload, ok = res.(MessageSyncTreeResponse); !ok {
+			return nil, fs.unexpected(peer.ID(), res)
+		}
+	}
+
+	var outdated []Record
+	for _, record := range records {
+		if !differing[merkleBucket(record.replicaKey())] {
+			continue
+		}
+		if their, ok := theirs[record.replicaKey()]; ok && their.Version >= record.Version {
+			continue
+		}
+		outdated = append(outdated, record)
+	}
+
+	return outdated, nil
+}
+
+func (fs *FileServer) handleMessageSyncTree(ctx context.Context, from string, msg MessageSyncTree) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	// the sender summarised the replicas it holds which this node owns,
+	// they are compared with the ones this node holds
+	records, err := fs.sharedReplicas(fs.ID)
+	if err != nil {
+		return err
+	}
+
+	res := syncRecords(records, newMerkleTree(records).diff(&msg.Tree), "")
+	res.RequestID = msg.RequestID
+	return fs.send(ctx, peer, &Message{Payload: res})
+}
+
+func (fs *FileServer) handleMessageSyncRecords(ctx context.Context, from string, msg MessageSyncRecords) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	records, err := fs.sharedReplicas(fs.ID)
+	if err != nil {
+		return err
+	}
+
+	res := syncRecords(records, msg.Buckets, msg.After)
+	res.RequestID = msg.RequestID
+	return fs.send(ctx, peer, &Message{Payload: res})
+}
+
+// syncRecords returns the response listing the records in buckets which follow
+// the key of the replica after, as many as fit in maxSyncRecordBytes
+func syncRecords(records []Record, buckets []int, after string) MessageSyncTreeResponse {
+	differing := make(map[int]bool, len(buckets))
+	for _, bucket := range buckets {
+		differing[bucket] = true
+	}
+
+	var following []Record
+	for _, record := range records {
+		key := record.replicaKey()
+		if differing[merkleBucket(key)] && key > after {
+			following = append(following, record)
+		}
+	}
+	slices.SortFunc(following, func(a, b Record) int {
+		return strings.Compare(a.replicaKey(), b.replicaKey())
+	})
+
+	res := MessageSyncTreeResponse{Buckets: buckets}
+	size := 0
+	for _, record := range following {
+		size += recordSize(record)
+		if len(res.Records) > 0 && size > maxSyncRecordBytes {
+			res.More = true
+			break
+		}
+		res.Records = append(res.Records, record)
+	}
+	return res
+}
+
+// recordSize estimates the number of bytes a record takes in a message
+func recordSize(r Record) int {
+	return len(r.Key) + len(r.Checksum) + len(r.Name) + len(r.SHA256) + len(r.ContentType) + 64
+}
+
+func init() {
+	gob.Register(MessageSyncTree{})
+	gob.Register(MessageSyncTreeResponse{})
+	gob.Register(MessageSyncRecords{})
+}
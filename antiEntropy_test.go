@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+)
+
+// plantReplica stores data on fs as if a peer had replicated it there
+func plantReplica(t *testing.T, fs *FileServer, key string, data []byte, version int64) Record {
+	t.Helper()
+
+	sum := sha256.Sum256(data)
+	record := Record{
+		Key:      key,
+		Version:  version,
+		Checksum: hex.EncodeToString(sum[:]),
+		Metadata: Metadata{Name: key, Size: int64(len(data))},
+	}
+
+	if _, err := fs.storage.Write(fs.ID, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.storage.WriteRecord(fs.ID, record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestAntiEntropyRepair(t *testing.T) {
+	stale := makeNewServer(":3016", "")
+	defer teardown(t, stale.storage)
+	go stale.Start()
+	defer stale.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	fs := makeNewServer(":3017", ":3016")
+	defer teardown(t, fs.storage)
+	go fs.Start()
+	defer fs.Stop()
+	waitForPeers(t, fs, 1)
+
+	key := "0123456789abcdef0123456789abcdef"
+	for i, data := range []string{"missed while offline", "a newer version"} {
+		record := plantReplica(t, fs, key, []byte(data), int64(i+1))
+
+		fs.antiEntropyRound(context.Background())
+
+		got, err := stale.storage.Record(stale.ID, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != record {
+			t.Errorf("wanted the repaired record %+v, got %+v", record, got)
+		}
+
+		if repairs := fs.AntiEntropyStats().Repairs; repairs != uint64(i+1) {
+			t.Errorf("wanted %d repairs, got %d", i+1, repairs)
+		}
+	}
+
+	// nothing is left to repair
+	fs.antiEntropyRound(context.Background())
+	if stats := fs.AntiEntropyStats(); stats.Repairs != 2 || stats.Rounds != 3 || stats.Failures != 0 {
+		t.Errorf("wanted 2 repairs in 3 rounds, got %+v", stats)
+	}
+}
+
+func TestAntiEntropyRepairFromLocal(t *testing.T) {
+	peer := makeNewServer(":3058", "")
+	defer teardown(t, peer.storage)
+	go peer.Start()
+	defer peer.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	fs := makeNewServer(":3059", ":3058")
+	defer teardown(t, fs.storage)
+	go fs.Start()
+	defer fs.Stop()
+	fs.WriteQuorum = 2
+	waitForPeers(t, fs, 1)
+
+	key := "missedbythepeer"
+	data := []byte("only written by the node itself")
+	if err := fs.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer lost its replica, the file written by fs is the only copy left
+	hashedKey := enc.HashKey(key)
+	if err := peer.storage.Delete(peer.ID, hashedKey); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.antiEntropyRound(context.Background())
+
+	local, err := fs.storage.Record(fs.ID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := peer.storage.Record(peer.ID, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != local.Version {
+		t.Fatalf("wanted the replica repaired to version %d, got %+v", local.Version, got)
+	}
+
+	_, r, err := peer.storage.Read(peer.ID, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := new(bytes.Buffer)
+	if _, err := enc.StreamDecrypt(fs.EncryptionKey, r, plain); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain.Bytes(), data) {
+		t.Errorf("wanted %s, got %s", data, plain)
+	}
+}
+
+func TestAntiEntropyTombstone(t *testing.T) {
+	stale := makeNewServer(":3060", "")
+	defer teardown(t, stale.storage)
+	go stale.Start()
+	defer stale.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	fs := makeNewServer(":3061", ":3060")
+	defer teardown(t, fs.storage)
+	go fs.Start()
+	defer fs.Stop()
+	fs.WriteQuorum = 2
+	waitForPeers(t, fs, 1)
+
+	key := "deletedwhileoffline"
+	if err := fs.Store(key, bytes.NewReader([]byte("gone for good"))); err != nil {
+		t.Fatal(err)
+	}
+
+	hashedKey := enc.HashKey(key)
+	record, err := stale.storage.Record(stale.ID, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := stale.storage.Read(stale.ID, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stale node missed the deletion and still holds its replica
+	plantReplica(t, stale, hashedKey, replica, record.Version)
+
+	// the replica is not written again over the deletion
+	stale.antiEntropyRound(context.Background())
+	for _, k := range []string{key, hashedKey} {
+		if fs.storage.Present(fs.ID, k) {
+			t.Errorf("wanted (%s) to stay deleted", k)
+		}
+	}
+
+	// and the deletion reaches the replica which missed it
+	fs.antiEntropyRound(context.Background())
+	if stale.storage.Present(stale.ID, hashedKey) {
+		t.Errorf("wanted the stale replica deleted")
+	}
+	tombstone, err := stale.storage.Record(stale.ID, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tombstone.Deleted || tombstone.Version <= record.Version {
+		t.Errorf("wanted a tombstone newer than version %d, got %+v", record.Version, tombstone)
+	}
+}
+
+func TestAntiEntropyManyRecords(t *testing.T) {
+	peer := makeNewServer(":3066", "")
+	peer.storage.Backend = NewMemoryBackend()
+	defer teardown(t, peer.storage)
+	go peer.Start()
+	defer peer.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	fs := makeNewServer(":3067", ":3066")
+	fs.storage.Backend = NewMemoryBackend()
+	defer teardown(t, fs.storage)
+	go fs.Start()
+	defer fs.Stop()
+	waitForPeers(t, fs, 1)
+
+	// far more records than fit in a single message, in every bucket
+	// some of them only the peer holds
+	var keys, theirs []string
+	for i := 0; i < 5000; i++ {
+		keys = append(keys, enc.HashKey(fmt.Sprint(i)))
+		theirs = append(theirs, enc.HashKey(fmt.Sprint("peer", i)))
+	}
+	slices.Sort(keys)
+
+	sum := sha256.Sum256([]byte(keys[0]))
+	write := func(node *FileServer, keys []string) {
+		for _, key := range keys {
+			record := Record{Key: key, Version: 1, Checksum: hex.EncodeToString(sum[:]), Metadata: Metadata{Name: key, SHA256: hex.EncodeToString(sum[:])}}
+			if err := node.storage.WriteRecord(node.ID, record); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(peer, append(keys, theirs...))
+	write(fs, keys)
+
+	// only the replica sorted last is outdated on the peer
+	last := keys[len(keys)-1]
+	record, err := fs.storage.Record(fs.ID, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Version = 2
+	if err := fs.storage.WriteRecord(fs.ID, record); err != nil {
+		t.Fatal(err)
+	}
+
+	shared, err := fs.sharedReplicas(peer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := fs.peer(peer.ID)
+	outdated, err := fs.outdated(context.Background(), p, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outdated) != 1 || outdated[0].Key != last {
+		t.Errorf("wanted only (%s) outdated, got %d records", last, len(outdated))
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// partialFolder is the folder under the Root of a FileBackend holding the files
+// it is still writing, apart from the names it stores
+const partialFolder = ".partial"
+
+// Backend is where a Storage keeps its files. Names are slash separated
+// paths, a name missing from the backend gives an error wrapping fs.ErrNotExist.
+type Backend interface {
+	// Put stores everything read from r under name, replacing what was there
+	Put(name string, r io.Reader) (int64, error)
+
+	// Get returns the size of the file stored under name and a reader of it
+	Get(name string) (int64, io.ReadCloser, error)
+
+	Has(name string) bool
+
+	// Delete removes the file stored under name, or every file under name
+	// if it is a folder. Deleting a missing name is not an error.
+	Delete(name string) error
+
+	Stat(name string) (Entry, error)
+
+	// List returns the sorted names of the files starting with prefix
+	List(prefix string) ([]string, error)
+}
+
+// Entry describes a file stored in a Backend
+type Entry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// FileBackend keeps the files on the disk under Root,
+// names starting with the partialFolder are its own
+type FileBackend struct {
+	Root string
+}
+
+func NewFileBackend(root string) *FileBackend {
+	return &FileBackend{
+		Root: root,
+	}
+}
+
+func (b *FileBackend) path(name string) string {
+	return filepath.Join(b.Root, filepath.FromSlash(name))
+}
+
+// Put writes to a partial file in the partialFolder which is synced
+// and renamed over the one of name once complete, so a file is either missing or whole
+func (b *FileBackend) Put(name string, r io.Reader) (int64, error) {
+	path := b.path(name)
+	dir := filepath.Dir(path)
+	partials := b.path(partialFolder)
+	for _, d := range []string{dir, partials} {
+		if err := makeDirs(d); err != nil {
+			return 0, err
+		}
+	}
+
+	f, err := os.CreateTemp(partials, filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return n, err
+	}
+
+	return n, syncDir(dir)
+}
+
+// syncDir makes a rename in dir survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// makeDirs creates dir along with its missing parents like os.MkdirAll
+// and syncs the parent of every folder it creates, so they survive a crash
+func makeDirs(dir string) error {
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		return nil
+	}
+
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := makeDirs(parent); err != nil {
+			return err
+		}
+	}
+
+	// another Put may have created it meanwhile
+	err := os.Mkdir(dir, os.ModePerm)
+	if errors.Is(err, fs.ErrExist) {
+		if fi, statErr := os.Stat(dir); statErr == nil && fi.IsDir() {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return syncDir(parent)
+}
+
+// CleanPartial removes the partial files left by the writes
+// a crash interrupted, it is to be called before any Put
+func (b *FileBackend) CleanPartial() error {
+	partials := b.path(partialFolder)
+
+	entries, err := os.ReadDir(partials)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(partials, entry.Name())
+		log.Printf("removing partial file %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *FileBackend) Get(name string) (int64, io.ReadCloser, error) {
+	f, err := os.Open(b.path(name))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+
+	return fi.Size(), f, nil
+}
+
+func (b *FileBackend) Has(name string) bool {
+	_, err := b.Stat(name)
+	return err == nil
+}
+
+func (b *FileBackend) Delete(name string) error {
+	return os.RemoveAll(b.path(name))
+}
+
+func (b *FileBackend) Stat(name string) (Entry, error) {
+	fi, err := os.Stat(b.path(name))
+	if err != nil {
+		return Entry{}, err
+	}
+	if fi.IsDir() {
+		return Entry{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return Entry{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (b *FileBackend) List(prefix string) ([]string, error) {
+	var names []string
+
+	// only the folder the prefix ends in needs to be walked
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+
+	partials := b.path(partialFolder)
+	err := filepath.WalkDir(b.path(dir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path == partials {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.Root, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	return names, err
+}
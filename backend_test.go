@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"testing"
+	"testing/iotest"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+)
+
+func testBackend(t *testing.T, b Backend) {
+	defer b.Delete("")
+
+	data := []byte("kept by the backend")
+	if n, err := b.Put("a/b/file", bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+		t.Fatalf("wanted %d bytes put, got %d (%v)", len(data), n, err)
+	}
+	if !b.Has("a/b/file") {
+		t.Errorf("expected a/b/file to be present")
+	}
+	if b.Has("a/b") {
+		t.Errorf("expected a folder not to be mistaken for a file")
+	}
+
+	size, r, err := b.Get("a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if size != int64(len(data)) || !bytes.Equal(got, data) {
+		t.Errorf("wanted %s (%d bytes), got %s (%d bytes)", data, len(data), got, size)
+	}
+
+	// a failed Put keeps what was there
+	failed := io.MultiReader(bytes.NewReader([]byte("half of it")), iotest.ErrReader(io.ErrUnexpectedEOF))
+	if _, err := b.Put("a/b/file", failed); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("wanted %s, got %v", io.ErrUnexpectedEOF, err)
+	}
+	if _, err := b.Put("a/b/failed", iotest.ErrReader(io.ErrUnexpectedEOF)); err == nil {
+		t.Errorf("wanted the put to fail")
+	}
+	if b.Has("a/b/failed") {
+		t.Errorf("expected nothing kept of a failed put")
+	}
+
+	if entry, err := b.Stat("a/b/file"); err != nil || entry.Size != int64(len(data)) || entry.ModTime.IsZero() {
+		t.Errorf("wanted the entry of %d bytes, got %+v (%v)", len(data), entry, err)
+	}
+	if _, _, err := b.Get("a/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("wanted %s, got %v", fs.ErrNotExist, err)
+	}
+	if _, err := b.Stat("a/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("wanted %s, got %v", fs.ErrNotExist, err)
+	}
+
+	for _, name := range []string{"a/b/other", "a/c", "ab"} {
+		if _, err := b.Put(name, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for prefix, want := range map[string][]string{
+		"":      {"a/b/file", "a/b/other", "a/c", "ab"},
+		"a/":    {"a/b/file", "a/b/other", "a/c"},
+		"a/b/o": {"a/b/other"},
+		"x/":    nil,
+	} {
+		names, err := b.List(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("wanted %v listed under (%s), got %v", want, prefix, names)
+		}
+	}
+
+	// deleting a folder deletes everything under it, not the names next to it
+	if err := b.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("a"); err != nil {
+		t.Errorf("wanted deleting a missing name to succeed, got %v", err)
+	}
+	if names, _ := b.List(""); !slices.Equal(names, []string{"ab"}) {
+		t.Errorf("wanted only ab left, got %v", names)
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	testBackend(t, NewFileBackend(t.TempDir()))
+}
+
+func TestFileBackendPartial(t *testing.T) {
+	b := NewFileBackend(t.TempDir())
+
+	if _, err := b.Put("a/file", bytes.NewReader([]byte("whole"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// a name which looks like a partial file is a file like any other
+	if _, err := b.Put("a/.file.partial", bytes.NewReader([]byte("whole as well"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// left by a write a crash interrupted
+	partial := b.path(partialFolder + "/file.123")
+	if err := os.WriteFile(partial, []byte("wh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if names, err := b.List(""); err != nil || !slices.Equal(names, []string{"a/.file.partial", "a/file"}) {
+		t.Errorf("wanted the partial file not listed, got %v (%v)", names, err)
+	}
+
+	if err := b.CleanPartial(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("expected the partial file removed, got %v", err)
+	}
+	for _, name := range []string{"a/file", "a/.file.partial"} {
+		if !b.Has(name) {
+			t.Errorf("expected %s kept", name)
+		}
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, NewMemoryBackend())
+}
+
+func TestFileServerMemoryBackend(t *testing.T) {
+	root := t.TempDir() + "/unused"
+
+	fs, err := NewFileServer(FileServerConfig{
+		EncryptionKey:      enc.NewEncryptionKey(),
+		StorageRoot:        root,
+		PathTransformation: CASPathTransformFunc,
+		StorageBackend:     NewMemoryBackend(),
+		Transport:          makeNewServer(":3039", "").Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown(t, fs.storage)
+
+	data := []byte("never on the disk")
+	if err := fs.Store("inmemory", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.Get("inmemory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	if !bytes.Equal(got, data) {
+		t.Errorf("wanted %s, got %s", data, got)
+	}
+
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("expected nothing written under %s, got %v", root, err)
+	}
+}
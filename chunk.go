@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// defining the largest chunk a stream is split into on the wire
+const streamChunkSize = 32 * 1024
+
+var (
+	errStreamAborted   = errors.New("stream aborted by the sender")
+	errTrailerTooLarge = errors.New("stream trailer larger than a chunk")
+)
+
+// chunkWriter frames a stream of unknown size into chunks.
+// Every chunk is a varint length followed by as many bytes,
+// a length of zero ends the stream and a negative length aborts it.
+// The end is followed by a trailer, framed like a chunk.
+type chunkWriter struct {
+	w io.Writer
+
+	// a chunk is put together with its header, so it goes out in a single write
+	buffer []byte
+}
+
+func newChunkWriter(w io.Writer) *chunkWriter {
+	return &chunkWriter{
+		w:      w,
+		buffer: make([]byte, 0, binary.MaxVarintLen64+streamChunkSize),
+	}
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		size := min(len(p), streamChunkSize)
+
+		chunk := binary.AppendVarint(cw.buffer[:0], int64(size))
+		chunk = append(chunk, p[:size]...)
+		if _, err := cw.w.Write(chunk); err != nil {
+			return written, err
+		}
+
+		written += size
+		p = p[size:]
+	}
+
+	return written, nil
+}
+
+// Close marks the end of the stream
+func (cw *chunkWriter) Close() error {
+	return cw.CloseWithTrailer(nil)
+}
+
+// CloseWithTrailer marks the end of the stream and sends the trailer after it,
+// telling the receiver what is only known once everything was sent
+func (cw *chunkWriter) CloseWithTrailer(trailer []byte) error {
+	if len(trailer) > streamChunkSize {
+		return errTrailerTooLarge
+	}
+
+	end := binary.AppendVarint(cw.buffer[:0], 0)
+	end = binary.AppendVarint(end, int64(len(trailer)))
+	end = append(end, trailer...)
+
+	_, err := cw.w.Write(end)
+	return err
+}
+
+// Abort tells the receiver to throw away what it got so far
+func (cw *chunkWriter) Abort() error {
+	return cw.writeHeader(-1)
+}
+
+func (cw *chunkWriter) writeHeader(size int64) error {
+	_, err := cw.w.Write(binary.AppendVarint(cw.buffer[:0], size))
+	return err
+}
+
+// chunkReader reads a stream framed by chunkWriter and returns io.EOF
+// at its end, without reading a single byte past its trailer from r
+type chunkReader struct {
+	r         io.Reader
+	remaining int64
+	done      bool
+	trailer   []byte
+}
+
+func newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{r: r}
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.done {
+		return 0, io.EOF
+	}
+
+	if cr.remaining == 0 {
+		size, err := binary.ReadVarint(cr)
+		if err == io.EOF {
+			// the stream ended without being closed by the sender
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case size == 0:
+			cr.done = true
+			return 0, cr.readTrailer()
+		case size < 0 || size > streamChunkSize:
+			cr.done = true
+			return 0, errStreamAborted
+		}
+		cr.remaining = size
+	}
+
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+
+	n, err := cr.r.Read(p)
+	cr.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readTrailer reads the trailer following the end of the stream
+// and returns io.EOF once it did
+func (cr *chunkReader) readTrailer() error {
+	size, err := binary.ReadVarint(cr)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if size < 0 || size > streamChunkSize {
+		return errTrailerTooLarge
+	}
+
+	trailer := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, trailer); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	cr.trailer = trailer
+
+	return io.EOF
+}
+
+// Trailer returns the trailer sent after the stream, once Read returned io.EOF
+func (cr *chunkReader) Trailer() []byte {
+	return cr.trailer
+}
+
+// ReadByte lets binary.ReadVarint read the chunk header byte by byte
+func (cr *chunkReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(cr.r, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
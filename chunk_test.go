@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestChunkStream(t *testing.T) {
+	data := bytes.Repeat([]byte("chunked"), streamChunkSize)
+	wire := new(bytes.Buffer)
+
+	cw := newChunkWriter(wire)
+	if _, err := cw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	trailer := []byte("known at the end")
+	if err := cw.CloseWithTrailer(trailer); err != nil {
+		t.Fatal(err)
+	}
+
+	// anything after the end of the stream must be left unread
+	wire.WriteString("next")
+
+	cr := newChunkReader(wire)
+	b, err := io.ReadAll(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("wanted %d bytes, got %d", len(data), len(b))
+	}
+	if !bytes.Equal(cr.Trailer(), trailer) {
+		t.Errorf("wanted the trailer %q, got %q", trailer, cr.Trailer())
+	}
+	if wire.String() != "next" {
+		t.Errorf("wanted next to be left unread, got %q", wire.String())
+	}
+}
+
+func TestChunkStreamAborted(t *testing.T) {
+	wire := new(bytes.Buffer)
+
+	cw := newChunkWriter(wire)
+	cw.Write([]byte("half a file"))
+	cw.Abort()
+
+	if _, err := io.ReadAll(newChunkReader(wire)); !errors.Is(err, errStreamAborted) {
+		t.Errorf("wanted %s, got %v", errStreamAborted, err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader stops reading from the underlying reader once the ctx is done,
+// which lets a plain io.Copy be cancelled between two reads
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newContextReader(ctx context.Context, r io.Reader) *contextReader {
+	return &contextReader{
+		ctx: ctx,
+		r:   r,
+	}
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// Close closes the underlying reader if it can be closed
+func (cr *contextReader) Close() error {
+	if rc, ok := cr.r.(io.Closer); ok {
+		return rc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+	gossip "github.com/palSagnik/Distributed-File-Storage/Gossip"
+)
+
+// MessageLeave tells the peers the sender is decommissioned,
+// so they no longer place files on it
+type MessageLeave struct{}
+
+// Decommission retires the node without losing data: Store is refused from now on,
+// the peers stop placing files on it and every file it holds is handed to its
+// other owners. Once all of them hold the files, the node is stopped.
+// If the ctx is done first, the node keeps running and Decommission may be called again.
+func (fs *FileServer) Decommission(ctx context.Context) error {
+	fs.decommissioned.Store(true)
+
+	fs.lockPeer.Lock()
+	fs.ring.Remove(fs.ID)
+	fs.members.Remove(fs.ID)
+	fs.lockPeer.Unlock()
+
+	fs.gossip.Leave()
+	if err := fs.broadcast(ctx, &Message{Payload: MessageLeave{}}); err != nil {
+		return err
+	}
+
+	// the owners which are disconnected are repaired by the anti-entropy of the others
+	if err := fs.storage.DeleteHints(fs.ID); err != nil {
+		return err
+	}
+
+	records, err := fs.storage.Records(fs.ID)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if len(record.Checksum) > 0 || record.Deleted {
+			continue
+		}
+		if err := fs.sealFile(ctx, record); err != nil {
+			return fmt.Errorf("[%s] decommissioning (%s): %w", fs.Transport.Addr(), record.Key, err)
+		}
+	}
+
+	for {
+		remaining := fs.rebalanceRound(ctx)
+		if remaining == 0 {
+			break
+		}
+		log.Printf("[%s] Decommissioning: %d replicas left to hand over", fs.Transport.Addr(), remaining)
+
+		select {
+		case <-time.After(fs.RebalanceDelay):
+		case <-ctx.Done():
+			return fmt.Errorf("[%s] decommissioning: %w", fs.Transport.Addr(), ctx.Err())
+		}
+	}
+
+	fmt.Printf("[%s] Decommissioned\n", fs.Transport.Addr())
+	fs.Stop()
+	return nil
+}
+
+// sealFile turns a file written by this node into a replica,
+// encrypted and stored under the hashed key as Store sends it to the peers
+func (fs *FileServer) sealFile(ctx context.Context, record Record) error {
+	hashedKey := enc.HashKey(record.Key)
+
+	// a newer replica of the same key from another node is kept
+	existing, err := fs.storage.Record(fs.ID, hashedKey)
+	if err != nil {
+		return err
+	}
+	if len(existing.Key) > 0 && existing.Version >= record.Version {
+		return fs.storage.Delete(fs.ID, record.Key)
+	}
+
+	_, r, err := fs.storage.ReadContext(ctx, fs.ID, record.Key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	var (
+		pr, pw   = io.Pipe()
+		checksum = sha256.New()
+	)
+	go func() {
+		_, err := enc.StreamEncryptContext(ctx, fs.EncryptionKey, r, io.MultiWriter(checksum, pw))
+		pw.CloseWithError(err)
+	}()
+
+	blob, err := fs.storage.WriteBlob(ctx, fs.ID, hashedKey, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+
+	metadata := record.Metadata
+	if len(metadata.Name) == 0 {
+		metadata.Name = record.Key
+	}
+	err = fs.storage.Commit(blob, func(existing Record) (Record, error) {
+		// or one which arrived while the file was sealed
+		if len(existing.Key) > 0 && existing.Version >= record.Version {
+			return existing, ErrOutdated
+		}
+		return Record{Key: hashedKey, Version: record.Version, Checksum: hex.EncodeToString(checksum.Sum(nil)), Metadata: metadata}, nil
+	})
+	if err != nil && !errors.Is(err, ErrOutdated) {
+		return err
+	}
+
+	return fs.storage.Delete(fs.ID, record.Key)
+}
+
+// handleMessageLeave takes a decommissioned peer off the ring,
+// it stays connected until it handed its files over
+func (fs *FileServer) handleMessageLeave(from string) error {
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
+
+	if _, ok := fs.peers[from]; !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	fs.ring.Remove(from)
+	fs.members.Remove(from)
+	fs.scheduleRebalance()
+
+	if m, ok := fs.gossip.Member(from); ok && m.State != gossip.Left {
+		m.State = gossip.Left
+		fs.gossip.Apply([]gossip.Member{m})
+	}
+	log.Printf("[%s] Node %s is decommissioned", fs.Transport.Addr(), from)
+
+	return nil
+}
+
+func init() {
+	gob.Register(MessageLeave{})
+}
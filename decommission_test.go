@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+)
+
+func TestDecommission(t *testing.T) {
+	var peers []*FileServer
+	for _, addr := range []string{":3026", ":3027"} {
+		fs := makeNewServer(addr, "")
+		fs.ReplicationFactor = 2
+		defer teardown(t, fs.storage)
+		go fs.Start()
+		defer fs.Stop()
+		peers = append(peers, fs)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	fs := makeNewServer(":3028", ":3026", ":3027")
+	fs.ReplicationFactor = 2
+	fs.RebalanceDelay = 10 * time.Millisecond
+	defer teardown(t, fs.storage)
+
+	keys := []string{enc.HashKey("written")}
+	for i := 0; i < 10; i++ {
+		key := enc.HashKey(fmt.Sprintf("decommissioned_%d", i))
+		plantReplica(t, fs, key, []byte(key), 1)
+		keys = append(keys, key)
+	}
+
+	// a file this node wrote itself is kept in plain text
+	if _, err := fs.storage.Write(fs.ID, "written", bytes.NewReader([]byte("written here"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.storage.WriteRecord(fs.ID, Record{Key: "written", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	go fs.Start()
+	defer fs.Stop()
+	waitForPeers(t, fs, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := fs.Decommission(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if records, err := fs.storage.Records(fs.ID); err != nil || len(records) != 0 {
+		t.Errorf("wanted every file handed over, still holding %v (%v)", records, err)
+	}
+
+	// with two nodes left, both own every file
+	for _, peer := range peers {
+		for _, key := range keys {
+			if !peer.storage.Present(peer.ID, key) {
+				t.Errorf("wanted (%s) on %s", key, peer.Transport.Addr())
+			}
+		}
+	}
+
+	if err := fs.Store("refused", bytes.NewReader([]byte("too late"))); !errors.Is(err, ErrDecommissioned) {
+		t.Errorf("wanted %v, got %v", ErrDecommissioned, err)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"slices"
+	"time"
+
+	dht "github.com/palSagnik/Distributed-File-Storage/DHT"
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+	p2p "github.com/palSagnik/Distributed-File-Storage/Peer-To-Peer"
+)
+
+// MessageFindNode asks a peer for the nodes it knows closest to Target
+type MessageFindNode struct {
+	RequestID string
+	Target    dht.ID
+}
+
+type MessageFindNodeResponse struct {
+	RequestID string
+	Contacts  []dht.Contact
+}
+
+// MessageFindValue asks a peer for the providers of Key,
+// or the nodes it knows closest to Key if it knows of none
+type MessageFindValue struct {
+	RequestID string
+	Key       dht.ID
+}
+
+type MessageFindValueResponse struct {
+	RequestID string
+	Providers []dht.Contact
+	Contacts  []dht.Contact
+}
+
+// MessageAddProvider tells a peer that Provider holds the file of Key,
+// which the peer acknowledges with MessageAddProviderResponse
+type MessageAddProvider struct {
+	RequestID string
+	Key       dht.ID
+	Provider  dht.Contact
+}
+
+type MessageAddProviderResponse struct {
+	RequestID string
+}
+
+// dhtNetwork carries the RPCs of the DHT as messages between file servers,
+// connecting to the nodes which are not peers yet
+type dhtNetwork struct {
+	fs *FileServer
+}
+
+func (n dhtNetwork) FindNode(ctx context.Context, to dht.Contact, target dht.ID) ([]dht.Contact, error) {
+	res, err := n.fs.call(ctx, to, func(requestID string) any {
+		return MessageFindNode{RequestID: requestID, Target: target}
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, ok := res.(MessageFindNodeResponse)
+	if !ok {
+		return nil, n.fs.unexpected(to.ID, res)
+	}
+	return payload.Contacts, nil
+}
+
+func (n dhtNetwork) FindValue(ctx context.Context, to dht.Contact, key dht.ID) ([]dht.Contact, []dht.Contact, error) {
+	res, err := n.fs.call(ctx, to, func(requestID string) any {
+		return MessageFindValue{RequestID: requestID, Key: key}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, ok := res.(MessageFindValueResponse)
+	if !ok {
+		return nil, nil, n.fs.unexpected(to.ID, res)
+	}
+	return payload.Providers, payload.Contacts, nil
+}
+
+func (n dhtNetwork) Store(ctx context.Context, to dht.Contact, key dht.ID, provider dht.Contact) error {
+	res, err := n.fs.call(ctx, to, func(requestID string) any {
+		return MessageAddProvider{RequestID: requestID, Key: key, Provider: provider}
+	})
+	if err != nil {
+		return err
+	}
+	if _, ok := res.(MessageAddProviderResponse); !ok {
+		return n.fs.unexpected(to.ID, res)
+	}
+	return nil
+}
+
+// call sends the message built for a new request to a node and waits for its response.
+// A node which is not a peer is connected to for the call only, which keeps
+// the lookups of the DHT and the probes of gossip from adding peers.
+func (fs *FileServer) call(ctx context.Context, to dht.Contact, payload func(requestID string) any) (any, error) {
+	peer, err := fs.dial(ctx, to, true)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.hangUp(peer)
+
+	return fs.request(ctx, peer, payload)
+}
+
+// hangUp ends a call over the connection to a peer. The connection dialed
+// for calls only is closed once the last call over it ended.
+func (fs *FileServer) hangUp(peer p2p.Peer) {
+	fs.lockPeer.Lock()
+	n, ok := fs.calls[peer]
+	if ok && n > 1 {
+		fs.calls[peer] = n - 1
+		ok = false
+	} else if ok {
+		delete(fs.calls, peer)
+		if fs.peers[peer.ID()] == peer {
+			delete(fs.peers, peer.ID())
+		}
+	}
+	fs.lockPeer.Unlock()
+
+	if ok {
+		peer.Close()
+	}
+}
+
+// connect returns the peer of a contact, dialing it if it is not connected yet
+func (fs *FileServer) connect(ctx context.Context, c dht.Contact) (p2p.Peer, error) {
+	return fs.dial(ctx, c, false)
+}
+
+// dial returns the peer of a contact, dialing it if it is not connected yet.
+// Only one dial per address is in flight, everyone else waits for it.
+// A node which is dialed for calls only is not one of the nodes the files are
+// placed on, and every call has to be ended by hangUp.
+func (fs *FileServer) dial(ctx context.Context, c dht.Contact, call bool) (p2p.Peer, error) {
+	fs.lockPeer.Lock()
+	peer, ok := fs.peers[c.ID]
+	waiting := fs.dialing[c.Addr]
+	if ok {
+		fs.use(peer, call)
+	} else if !waiting {
+		fs.dialing[c.Addr] = true
+		if call {
+			fs.outbound[c.Addr]++
+		}
+	}
+	fs.lockPeer.Unlock()
+
+	if ok {
+		return peer, nil
+	}
+
+	if !waiting {
+		defer func() {
+			fs.lockPeer.Lock()
+			delete(fs.dialing, c.Addr)
+			fs.lockPeer.Unlock()
+		}()
+
+		if err := fs.Transport.Dial(c.Addr); err != nil {
+			if call {
+				fs.lockPeer.Lock()
+				fs.dialed(c.Addr)
+				fs.lockPeer.Unlock()
+			}
+			return nil, err
+		}
+	}
+
+	// the peer is registered once the handshake completes
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		fs.lockPeer.Lock()
+		peer, ok := fs.peers[c.ID]
+		dialing := fs.dialing[c.Addr]
+		if ok {
+			fs.use(peer, call)
+		}
+		fs.lockPeer.Unlock()
+
+		if ok {
+			return peer, nil
+		}
+		if waiting && !dialing {
+			return nil, fmt.Errorf("[%s] connecting to node %s at %s failed", fs.Transport.Addr(), c.ID, c.Addr)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("[%s] connecting to node %s at %s: %w", fs.Transport.Addr(), c.ID, c.Addr, ctx.Err())
+		}
+	}
+}
+
+// dialed takes back a connection to addr dialed for calls only which is no longer
+// pending and reports whether there was one, caller holds lockPeer
+func (fs *FileServer) dialed(addr string) bool {
+	n := fs.outbound[addr]
+	if n > 1 {
+		fs.outbound[addr] = n - 1
+	} else {
+		delete(fs.outbound, addr)
+	}
+	return n > 0
+}
+
+// use takes a peer for a call or for good, caller holds lockPeer.
+// A peer dialed for calls only is kept once it is taken for good.
+func (fs *FileServer) use(peer p2p.Peer, call bool) {
+	n, ok := fs.calls[peer]
+	switch {
+	case !ok:
+	case call:
+		fs.calls[peer] = n + 1
+	default:
+		delete(fs.calls, peer)
+		fs.join(peer)
+	}
+}
+
+// contact is how the DHT reaches a peer
+func contact(peer p2p.Peer) dht.Contact {
+	return dht.Contact{ID: peer.ID(), Addr: peer.Info().ListenAddr}
+}
+
+// providers looks up the nodes which announced the file in the DHT
+// and connects to the ones not asked yet
+func (fs *FileServer) providers(ctx context.Context, key string, asked []p2p.Peer) []p2p.Peer {
+	contacts, err := fs.dht.FindProviders(ctx, dht.NewID(enc.HashKey(key)))
+	if err != nil {
+		fmt.Printf("[%s] Looking up providers of (%s): %s\n", fs.Transport.Addr(), key, err)
+		return nil
+	}
+
+	var peers []p2p.Peer
+	for _, c := range contacts {
+		if c.ID == fs.ID || slices.ContainsFunc(asked, func(p p2p.Peer) bool { return p.ID() == c.ID }) {
+			continue
+		}
+
+		peer, err := fs.connect(ctx, c)
+		if err != nil {
+			fmt.Printf("[%s] Provider of (%s) unreachable: %s\n", fs.Transport.Addr(), key, err)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+func (fs *FileServer) handleMessageFindNode(ctx context.Context, from string, msg MessageFindNode) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	res := MessageFindNodeResponse{
+		RequestID: msg.RequestID,
+		Contacts:  fs.dht.HandleFindNode(contact(peer), msg.Target),
+	}
+	return fs.send(ctx, peer, &Message{Payload: res})
+}
+
+func (fs *FileServer) handleMessageFindValue(ctx context.Context, from string, msg MessageFindValue) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	res := MessageFindValueResponse{RequestID: msg.RequestID}
+	res.Providers, res.Contacts = fs.dht.HandleFindValue(contact(peer), msg.Key)
+	return fs.send(ctx, peer, &Message{Payload: res})
+}
+
+func (fs *FileServer) handleMessageAddProvider(ctx context.Context, from string, msg MessageAddProvider) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	fs.dht.HandleStore(contact(peer), msg.Key, msg.Provider)
+	return fs.send(ctx, peer, &Message{Payload: MessageAddProviderResponse{RequestID: msg.RequestID}})
+}
+
+func init() {
+	gob.Register(MessageFindNode{})
+	gob.Register(MessageFindNodeResponse{})
+	gob.Register(MessageFindValue{})
+	gob.Register(MessageFindValueResponse{})
+	gob.Register(MessageAddProvider{})
+	gob.Register(MessageAddProviderResponse{})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	dht "github.com/palSagnik/Distributed-File-Storage/DHT"
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+)
+
+func TestGetFromProvider(t *testing.T) {
+	hub := makeNewServer(":3009", "")
+	local := makeNewServer(":3010", "")
+	holder := makeNewServer(":3011", "")
+
+	// the file is read by a node sharing the key of the node which stored it
+	local.EncryptionKey = holder.EncryptionKey
+
+	// the hub is the only peer they look for
+	local.PeerTarget, holder.PeerTarget = 1, 1
+
+	for _, fs := range []*FileServer{hub, local, holder} {
+		defer teardown(t, fs.storage)
+		go fs.Start()
+		defer fs.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// local and holder only know the hub
+	for _, fs := range []*FileServer{local, holder} {
+		if err := fs.Transport.Dial(hub.Transport.Addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForPeers(t, hub, 2)
+
+	key := "farawayfile"
+	data := []byte("two hops away")
+
+	ciphertext := new(bytes.Buffer)
+	if _, err := enc.StreamEncrypt(holder.EncryptionKey, bytes.NewReader(data), ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := holder.storage.Write(holder.ID, enc.HashKey(key), ciphertext); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hub learns that holder provides the file
+	peer, ok := holder.peer(hub.ID)
+	if !ok {
+		t.Fatalf("expected %s to be connected to %s", holder.ID, hub.ID)
+	}
+	network := dhtNetwork{holder}
+	if err := network.Store(context.Background(), contact(peer), dht.NewID(enc.HashKey(key)), holder.dht.Self()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ok := local.peer(holder.ID); ok {
+		t.Fatalf("expected %s not to be connected to %s yet", local.ID, holder.ID)
+	}
+
+	r, err := local.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("wanted %s, got %s", data, b)
+	}
+}
@@ -1,26 +1,105 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	dht "github.com/palSagnik/Distributed-File-Storage/DHT"
 	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+	gossip "github.com/palSagnik/Distributed-File-Storage/Gossip"
 	p2p "github.com/palSagnik/Distributed-File-Storage/Peer-To-Peer"
 )
 
+const (
+	// defining how long a network request waits for responses from peers
+	defaultRequestTimeout = 5 * time.Second
+
+	// defining on how many nodes every file is placed
+	defaultReplicationFactor = 3
+)
+
+// ErrFileNotFound is returned by Get when neither the local disk
+// nor any of the connected peers has the requested file
+var ErrFileNotFound = errors.New("file not found in the network")
+
+// ErrDecommissioned is returned by Store once the node is being decommissioned
+var ErrDecommissioned = errors.New("node is decommissioned")
+
+// ErrQuorumNotMet is returned by Store and Get when fewer replicas
+// than WriteQuorum or ReadQuorum took part in the request
+var ErrQuorumNotMet = errors.New("quorum not met")
+
+// ErrUnexpectedResponse is returned when a peer answers a request
+// with a message which is not a response to it
+var ErrUnexpectedResponse = errors.New("unexpected response")
+
+// ErrOutdated is returned when a replica is sent to a peer
+// which already holds a newer version of it
+var ErrOutdated = errors.New("newer version held by the peer")
+
 type FileServerConfig struct {
-	ID 			   	   string
-	EncryptionKey      []byte
+	ID            string
+	EncryptionKey []byte
+
+	// NodeKey authenticates the node to its peers, a new one is made if nil.
+	// If ID is empty, it is derived from NodeKey, otherwise it has to match it.
+	NodeKey            ed25519.PrivateKey
 	StorageRoot        string
 	PathTransformation PathTransformFunc
-	Transport          p2p.Transport
-	NodeList           []string
+
+	// StorageBackend keeps the files, the disk under StorageRoot if nil
+	StorageBackend Backend
+
+	Transport p2p.Transport
+	NodeList  []string
+
+	// RequestTimeout bounds how long a request waits for peer responses
+	RequestTimeout time.Duration
+
+	// ReconnectBackoff is the first delay before a node of the NodeList
+	// is dialed again, doubling after every failure up to MaxReconnectBackoff
+	ReconnectBackoff    time.Duration
+	MaxReconnectBackoff time.Duration
+
+	// ReplicationFactor is the number of nodes, this one included,
+	// a file is placed on by the hash ring
+	ReplicationFactor int
+
+	// WriteQuorum is the number of replicas which must acknowledge a Store,
+	// ReadQuorum the number of replicas a Get must hear from.
+	// Both count this node if it is an owner of the key and default to 1.
+	WriteQuorum int
+	ReadQuorum  int
+
+	// AntiEntropyInterval is how often the replicas are compared with every peer
+	AntiEntropyInterval time.Duration
+
+	// RebalanceDelay is how long the membership must stay unchanged
+	// before the replicas move to their new owners, RebalanceBandwidth
+	// caps the bytes per second they are sent at, unlimited if 0
+	RebalanceDelay     time.Duration
+	RebalanceBandwidth int64
+
+	// GossipInterval is how often a member of the cluster is probed
+	GossipInterval time.Duration
+
+	// PeerTarget is the number of peers the node connects to on its own
+	// after learning about them from the peers it is connected to
+	PeerTarget int
 }
 
 type FileServer struct {
@@ -29,151 +108,1297 @@ type FileServer struct {
 	lockPeer sync.Mutex
 	peers    map[string]p2p.Peer
 
+	// dialing holds the addresses being dialed and outbound counts the connections
+	// dialed for calls only which are not registered yet, per address.
+	// calls counts the calls in flight over the connections dialed for calls only.
+	// All of them are guarded by lockPeer.
+	dialing  map[string]bool
+	outbound map[string]int
+	calls    map[p2p.Peer]int
+
+	// connectionEvents wakes up the reconnection of a NodeList entry,
+	// keyed by listen address and guarded by lockPeer
+	connectionEvents map[string]chan struct{}
+
+	// ring places the files on this node and the peers, guarded by lockPeer
+	ring *hashRing
+
+	// members is the ring of every node which was ever a peer,
+	// the disconnected ones included, guarded by lockPeer
+	members *hashRing
+
+	// dht locates the holders of files among nodes which are not peers
+	dht *dht.DHT
+
+	// gossip keeps the view of the cluster members and detects failed ones
+	gossip *gossip.Gossip
+
+	antiEntropyCounters antiEntropyCounters
+
+	// rebalanceChannel wakes up the rebalancer on a membership change
+	rebalanceChannel chan struct{}
+	rebalanceState   rebalanceState
+
+	// decommissioned is set once the node hands its files over to leave
+	decommissioned atomic.Bool
+
+	// requests holds every in-flight request
+	// keyed by the request ID carried in the message
+	lockRequests sync.Mutex
+	requests     map[string]*pendingRequest
+
 	storage     *Storage
 	quitChannel chan struct{}
+	stopOnce    sync.Once
+
+	// ctx is cancelled on Stop and bounds the work done for peers
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewFileServer(config FileServerConfig) *FileServer {
+// response is a reply from a peer routed to the request waiting on it
+type response struct {
+	From    string
+	Payload any
+}
+
+// pendingRequest delivers the responses of the peers a request was sent to,
+// each of which may answer once
+type pendingRequest struct {
+	peers     map[string]bool
+	responses chan response
+}
+
+// NewFileServer fails if the ID of the config is not the one derived from its NodeKey,
+// which the handshake would reject.
+func NewFileServer(config FileServerConfig) (*FileServer, error) {
 	storageConfig := StorageConfig{
 		Root:               config.StorageRoot,
 		PathTransformation: config.PathTransformation,
+		Backend:            config.StorageBackend,
+	}
+
+	if config.NodeKey == nil {
+		if len(config.ID) > 0 {
+			return nil, fmt.Errorf("node id (%s) given without the node key it is derived from", config.ID)
+		}
+		config.NodeKey = enc.NewNodeKey()
 	}
 
+	id := p2p.NodeIDFromKey(config.NodeKey.Public().(ed25519.PublicKey))
 	if len(config.ID) == 0 {
-		config.ID = enc.GenerateID()
+		config.ID = id
+	}
+	if config.ID != id {
+		return nil, fmt.Errorf("node id (%s) is not derived from the node key, which gives (%s)", config.ID, id)
+	}
+
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = defaultRequestTimeout
+	}
+
+	if config.ReconnectBackoff == 0 {
+		config.ReconnectBackoff = defaultReconnectBackoff
+	}
+
+	if config.MaxReconnectBackoff == 0 {
+		config.MaxReconnectBackoff = defaultMaxReconnectBackoff
+	}
+
+	if config.ReplicationFactor == 0 {
+		config.ReplicationFactor = defaultReplicationFactor
 	}
 
-	return &FileServer{
+	if config.WriteQuorum == 0 {
+		config.WriteQuorum = 1
+	}
+
+	if config.ReadQuorum == 0 {
+		config.ReadQuorum = 1
+	}
+
+	if config.AntiEntropyInterval == 0 {
+		config.AntiEntropyInterval = defaultAntiEntropyInterval
+	}
+
+	if config.RebalanceDelay == 0 {
+		config.RebalanceDelay = defaultRebalanceDelay
+	}
+
+	if config.PeerTarget == 0 {
+		config.PeerTarget = defaultPeerTarget
+	}
+
+	ring := newHashRing(defaultVirtualNodes)
+	ring.Add(config.ID)
+
+	members := newHashRing(defaultVirtualNodes)
+	members.Add(config.ID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fs := &FileServer{
 		FileServerConfig: config,
+		ctx:              ctx,
+		cancel:           cancel,
 		storage:          NewStorage(storageConfig),
 		quitChannel:      make(chan struct{}),
 		peers:            make(map[string]p2p.Peer),
+		dialing:          make(map[string]bool),
+		outbound:         make(map[string]int),
+		calls:            make(map[p2p.Peer]int),
+		connectionEvents: make(map[string]chan struct{}),
+		ring:             ring,
+		members:          members,
+		rebalanceChannel: make(chan struct{}, 1),
+		requests:         make(map[string]*pendingRequest),
 	}
+	fs.dht = dht.New(dht.Contact{ID: config.ID, Addr: config.Transport.Addr()}, dhtNetwork{fs})
+	fs.gossip = gossip.New(gossip.Config{
+		Self:          gossip.Member{ID: config.ID, Addr: config.Transport.Addr()},
+		Network:       gossipNetwork{fs},
+		ProbeInterval: config.GossipInterval,
+		OnChange:      fs.memberChanged,
+	})
+
+	return fs, nil
 }
 
 type Message struct {
 	Payload any
 }
 
+// MessageStoreFile announces a file which follows in chunks on the stream StreamID,
+// ended by a streamTrailer. The peer answers with MessageStoreFileAck once it is written.
+// Hints names the owners of the file which were disconnected,
+// the peer hands the file to them once they connect.
 type MessageStoreFile struct {
-	ID 		string
-	Key  	string
-	Size 	int64
+	ID        string
+	RequestID string
+	Key       string
+	Version   int64
+	StreamID  uint32
+	Hints     []string
+
+	// Metadata describes the file. Store does not know its Size and SHA256 yet,
+	// the peer counts the size from the bytes it receives and takes the SHA256 from the trailer.
+	Metadata Metadata
+}
+
+// streamTrailer follows a replica streamed to a peer with the checksums
+// of what was sent, which Store only knows once all of it was.
+// The peer checks the replica against them before it keeps it.
+type streamTrailer struct {
+	// Checksum is the SHA-256 of the replica as it was sent,
+	// SHA256 the one of the file before it was encrypted, empty if it is unknown
+	Checksum string
+	SHA256   string
+}
+
+// readTrailer returns the trailer of a stream read to its end
+func readTrailer(cr *chunkReader) (streamTrailer, error) {
+	var trailer streamTrailer
+	if len(cr.Trailer()) == 0 {
+		return trailer, nil
+	}
+
+	err := json.Unmarshal(cr.Trailer(), &trailer)
+	return trailer, err
+}
+
+// MessageStoreFileAck tells the sender of a file what was written to disk.
+// Error is set if the file could not be stored, Outdated if it was not
+// because the peer holds a newer version.
+type MessageStoreFileAck struct {
+	RequestID string
+	Key       string
+	Size      int64
+	Checksum  string
+	Error     string
+	Outdated  bool
 }
 
 type MessageGetFile struct {
-	ID 		string
-	Key 	string
+	ID        string
+	RequestID string
+	Key       string
+}
+
+// MessageGetFileResponse is the reply of a peer to MessageGetFile.
+// If Found is true, the file of Size bytes, Version, Checksum
+// and Metadata follows in chunks on the stream StreamID.
+type MessageGetFileResponse struct {
+	RequestID string
+	Key       string
+	Found     bool
+	Deleted   bool
+	Size      int64
+	Version   int64
+	Checksum  string
+	Metadata  Metadata
+	StreamID  uint32
 }
 
 func (fs *FileServer) Get(key string) (io.Reader, error) {
+	return fs.GetContext(context.Background(), key)
+}
 
-	if fs.storage.Present(fs.ID, key) {
+// GetContext is Get which gives up on the network search
+// and the transfer of the file once the ctx is done.
+// It hears from ReadQuorum replicas and returns the newest version among them.
+// A file not matching its checksum fails with ErrCorrupted, once downloaded
+// for a replica and once read to its end for the local copy.
+func (fs *FileServer) GetContext(ctx context.Context, key string) (io.Reader, error) {
+
+	local := fs.storage.PresentContext(ctx, fs.ID, key)
+	if local && fs.ReadQuorum <= 1 {
 		fmt.Printf("[%s] File (%s) found locally.\n", fs.Transport.Addr(), key)
 
-		_, r, err := fs.storage.Read(fs.ID, key)
+		_, r, err := fs.storage.ReadContext(ctx, fs.ID, key)
 		return r, err
 	}
 
-	fmt.Printf("[%s] No file (%s) found locally. Searching in network\n", fs.Transport.Addr(), key)
+	// the tombstone this node keeps of a deleted replica is a version of the file as well
+	hashedKey := enc.HashKey(key)
+	tombstone, err := fs.storage.Record(fs.ID, hashedKey)
+	if err != nil {
+		return nil, err
+	}
+	buried := tombstone.Deleted
+	if buried && !local && fs.ReadQuorum <= 1 {
+		return nil, fmt.Errorf("[%s] (%s) was deleted: %w", fs.Transport.Addr(), key, ErrFileNotFound)
+	}
+
+	if !local {
+		fmt.Printf("[%s] No file (%s) found locally. Searching in network\n", fs.Transport.Addr(), key)
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, fs.RequestTimeout)
+	defer cancel()
+
+	// the local copy or tombstone is one of the replicas read
+	answered, want := 0, fs.ReadQuorum
+	if local || buried {
+		answered, want = 1, want-1
+	}
+
+	// the owners of the key are asked first
+	peers, _ := fs.owners(key)
+	n, replicas, missing, err := fs.query(requestCtx, key, peers, want)
+	answered += n
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, r := range replicas {
+			r.discard()
+		}
+	}()
+
+	// the file may be held by nodes this one is not connected to,
+	// which announced it in the DHT
+	if !local && !buried && len(replicas) == 0 && requestCtx.Err() == nil {
+		n, replicas, _, err = fs.query(requestCtx, key, fs.providers(requestCtx, key, peers), want)
+		answered += n
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !local && !buried && len(replicas) == 0 {
+		if err := requestCtx.Err(); err != nil {
+			return nil, fmt.Errorf("[%s] waiting for (%s): %w", fs.Transport.Addr(), key, err)
+		}
+		return nil, fmt.Errorf("[%s] (%s): %w", fs.Transport.Addr(), key, ErrFileNotFound)
+	}
 
+	if answered < fs.ReadQuorum {
+		return nil, fmt.Errorf("[%s] reading (%s): %d of %d replicas answered: %w", fs.Transport.Addr(), key, answered, fs.ReadQuorum, ErrQuorumNotMet)
+	}
+
+	var newest *replica
+	for i := range replicas {
+		if newest == nil || replicas[i].Version > newest.Version {
+			newest = &replicas[i]
+		}
+	}
+
+	// the newer of the local copy and the tombstone is what this node holds
+	var own *Record
+	if local {
+		record, err := fs.storage.Record(fs.ID, key)
+		if err != nil {
+			return nil, err
+		}
+		own = &record
+	}
+	if buried && (own == nil || tombstone.Version > own.Version) {
+		own = &tombstone
+	}
+
+	// what this node holds is kept and repairs the other replicas unless a peer has a newer version
+	var (
+		deleted bool
+		version int64
+	)
+	if own != nil && (newest == nil || own.Version >= newest.Version) {
+		fs.localRepair(*own, replicas, missing)
+		deleted, version = own.Deleted, own.Version
+		newest = nil
+	}
+	if newest != nil {
+		fs.readRepair(newest, replicas, missing)
+		deleted, version = newest.Deleted, newest.Version
+	}
+
+	// the newest version is a deletion, which the copies this node missed it for follow
+	if deleted {
+		if _, _, err := fs.deleteCopies(requestCtx, hashedKey, key, version); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("[%s] (%s) was deleted: %w", fs.Transport.Addr(), key, ErrFileNotFound)
+	}
+
+	if newest != nil {
+		if err := fs.download(requestCtx, key, newest); err != nil {
+			return nil, err
+		}
+	}
+
+	_, r, err := fs.storage.ReadContext(ctx, fs.ID, key)
+	return r, err
+}
+
+// replica is a copy of a file a peer offered in response to MessageGetFile
+type replica struct {
+	peer p2p.Peer
+	MessageGetFileResponse
+
+	stream p2p.Stream
+}
+
+// discard closes the stream of a copy which is not downloaded,
+// which tells the peer to stop sending it
+func (r *replica) discard() {
+	if r.stream != nil {
+		r.stream.Close()
+	}
+}
+
+// query asks peers for the file and collects their answers until
+// want of them offered a copy, all of them answered or the ctx is done.
+// It returns the number of peers which answered, the copies offered,
+// which the caller must download or discard, and the peers without a copy.
+// A peer holding the tombstone of the file offers it like a copy without a stream.
+func (fs *FileServer) query(ctx context.Context, key string, peers []p2p.Peer, want int) (int, []replica, []p2p.Peer, error) {
+	requestID := enc.GenerateID()
 	msg := Message{
 		Payload: MessageGetFile{
-			Key: enc.HashKey(key),
-			ID: fs.ID,
+			ID:        fs.ID,
+			RequestID: requestID,
+			Key:       enc.HashKey(key),
 		},
 	}
 
-	if err := fs.broadcast(&msg); err != nil {
-		return nil, err
+	// every peer asked is expected to answer, either with the file or with a miss
+	expected := len(peers)
+
+	responses := fs.openRequest(requestID, peers)
+	defer fs.closeRequest(requestID)
+
+	for _, peer := range peers {
+		if err := fs.send(ctx, peer, &msg); err != nil {
+			log.Printf("[%s] Asking %s for (%s): %s", fs.Transport.Addr(), peer.ID(), key, err)
+			expected--
+		}
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	var (
+		answered int
+		replicas []replica
+		missing  []p2p.Peer
+	)
+collect:
+	for ; expected > 0 && len(replicas) < want; expected-- {
+		var res response
+		select {
+		case res = <-responses:
+		case <-ctx.Done():
+			break collect
+		}
+		payload, ok := res.Payload.(MessageGetFileResponse)
+		if !ok {
+			log.Printf("[%s] Asking for (%s): %s", fs.Transport.Addr(), key, fs.unexpected(res.From, res.Payload))
+			continue
+		}
+		answered++
+
+		peer, ok := fs.peer(res.From)
+		if !ok {
+			continue
+		}
 
-	for _, peer := range fs.peers {
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
-		n, err := fs.storage.WriteDecrypt(fs.ID, fs.EncryptionKey, key, io.LimitReader(peer, fileSize))
+		if payload.Deleted {
+			replicas = append(replicas, replica{peer: peer, MessageGetFileResponse: payload})
+			continue
+		}
+		if !payload.Found {
+			missing = append(missing, peer)
+			continue
+		}
+
+		stream, err := peer.AcceptStream(payload.StreamID)
 		if err != nil {
-			return nil, err // TODO: handle error properly
+			continue
 		}
 
-		fmt.Printf("[%s] Received %d bytes over the network from (%s)\n", fs.Transport.Addr(), n, peer.RemoteAddr())
+		replicas = append(replicas, replica{
+			peer:                   peer,
+			MessageGetFileResponse: payload,
+			stream:                 stream,
+		})
+	}
+
+	return answered, replicas, missing, nil
+}
+
+// download writes the copy of a peer to disk once it is decrypted.
+// A copy which does not match the checksums recorded by the peer
+// is not kept and ErrCorrupted is returned, the local copy is left as it was.
+func (fs *FileServer) download(ctx context.Context, key string, r *replica) error {
+	stream := r.stream
+	r.stream = nil
+	defer stream.Close()
+
+	var (
+		pr, pw    = io.Pipe()
+		cipherSum = sha256.New()
+		plainSum  = sha256.New()
+	)
+	go func() {
+		_, err := enc.StreamDecryptContext(ctx, fs.EncryptionKey, io.TeeReader(newChunkReader(stream), cipherSum), io.MultiWriter(pw, plainSum))
+		pw.CloseWithError(err)
+	}()
 
-		peer.CloseStream()
+	blob, err := fs.storage.WriteBlob(ctx, fs.ID, key, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
 	}
 
-	_, r, err := fs.storage.Read(fs.ID, key)
-	return r, err
+	metadata := r.Metadata
+	err = verifyChecksum(key, "replica", r.Checksum, hex.EncodeToString(cipherSum.Sum(nil)))
+	if err == nil {
+		err = verifyChecksum(key, "file", metadata.SHA256, hex.EncodeToString(plainSum.Sum(nil)))
+		metadata.SHA256 = hex.EncodeToString(plainSum.Sum(nil))
+	}
+	if err != nil {
+		fs.storage.Discard(blob)
+		return err
+	}
+
+	err = fs.storage.Commit(blob, func(Record) (Record, error) {
+		return Record{Key: key, Version: r.Version, Metadata: metadata}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] Received %d bytes over the network from (%s)\n", fs.Transport.Addr(), blob.Size, r.peer.RemoteAddr())
+	return nil
+}
+
+// verifyChecksum checks what was received of a file against
+// the checksum the sender recorded, unless it recorded none
+func verifyChecksum(key string, what string, want string, got string) error {
+	if len(want) > 0 && got != want {
+		return fmt.Errorf("(%s) %s received with checksum %s, sent %s: %w", key, what, got, want, ErrCorrupted)
+	}
+	return nil
 }
 
 func (fs *FileServer) Store(key string, r io.Reader) error {
+	return fs.StoreContext(context.Background(), key, r)
+}
+
+// StoreContext is Store which stops writing to disk
+// and streaming to the peers once the ctx is done.
+// The file is kept only by the owners of the key, which may not include this node.
+// It returns once WriteQuorum replicas acknowledged the file.
+func (fs *FileServer) StoreContext(ctx context.Context, key string, r io.Reader) error {
+	if fs.decommissioned.Load() {
+		return fmt.Errorf("[%s] storing (%s): %w", fs.Transport.Addr(), key, ErrDecommissioned)
+	}
+
+	peers, local := fs.owners(key)
+	hints := fs.assignHints(key, peers)
 
+	// the newest version of a file wins when replicas disagree
+	modified := time.Now()
+	version := modified.UnixNano()
+
+	br := bufio.NewReader(r)
+	r = br
+	metadata := Metadata{
+		Name:        key,
+		ContentType: contentType(key, br),
+		Created:     fs.created(key, modified),
+		Modified:    modified,
+	}
+
+	// the SHA-256 of the file is recorded by the node which stores it
+	plainSum := sha256.New()
+
+	// with no peer among the owners, this node is the only one
+	if len(peers) == 0 {
+		blob, err := fs.storage.WriteBlob(ctx, fs.ID, key, io.TeeReader(r, plainSum))
+		if err != nil {
+			return err
+		}
+		metadata.Size = blob.Size
+		metadata.SHA256 = hex.EncodeToString(plainSum.Sum(nil))
+		err = fs.storage.Commit(blob, func(Record) (Record, error) {
+			return Record{Key: key, Version: version, Metadata: metadata}, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("[%s] Written (%d) bytes to disk\n", fs.Transport.Addr(), blob.Size)
+		return fs.writeQuorum(key, 1)
+	}
+
+	requestID := enc.GenerateID()
+	acks := fs.openRequest(requestID, peers)
+	defer fs.closeRequest(requestID)
+
+	// every peer gets the file on a stream of its own. A peer which fails
+	// is left out, the acknowledgements decide whether enough of them got the file.
 	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
+		targets []p2p.Peer
+		streams []p2p.Stream
 	)
-	size, err := fs.storage.writeStream(fs.ID, key, tee)
+	defer func() {
+		for _, stream := range streams {
+			stream.Close()
+		}
+	}()
+
+	for i, peer := range peers {
+		stream, err := peer.OpenStream()
+		if err != nil {
+			fmt.Printf("[%s] Storing (%s) on %s failed: %s\n", fs.Transport.Addr(), key, peer.ID(), err)
+			continue
+		}
+
+		msg := Message{
+			Payload: MessageStoreFile{
+				ID:        fs.ID,
+				RequestID: requestID,
+				Key:       enc.HashKey(key),
+				Version:   version,
+				StreamID:  stream.ID(),
+				Hints:     hints[i],
+				Metadata:  metadata,
+			},
+		}
+		if err := fs.send(ctx, peer, &msg); err != nil {
+			stream.Close()
+			fmt.Printf("[%s] Storing (%s) on %s failed: %s\n", fs.Transport.Addr(), key, peer.ID(), err)
+			continue
+		}
+		targets = append(targets, peer)
+		streams = append(streams, stream)
+	}
+
+	// The file is never held in memory as a whole:
+	// what is read from r is written to disk if this node is an owner and, through a pipe,
+	// encrypted once and handed to a pipe per peer which streams it
+	// in chunks. Every stage only holds a buffer of its own.
+	// The checksum of the encrypted file is what the peers must acknowledge,
+	// they get it in the trailer along with the SHA-256 of the file.
+	var (
+		plainReader, plainWriter = io.Pipe()
+		pipes                    = make([]*io.PipeWriter, len(streams))
+		encrypted                = make(chan error, 1)
+		sending                  sync.WaitGroup
+		checksum                 = sha256.New()
+		sent                     int64
+		trailer                  streamTrailer
+	)
+
+	for i, stream := range streams {
+		pr, pw := io.Pipe()
+		pipes[i] = pw
+
+		sending.Add(1)
+		go func(peer p2p.Peer, stream p2p.Stream, pr *io.PipeReader) {
+			defer sending.Done()
+
+			// the trailer is complete once the pipe is closed
+			err := sendStream(stream, pr, func() streamTrailer { return trailer })
+			pr.CloseWithError(err)
+			if err != nil {
+				fmt.Printf("[%s] Streaming (%s) to %s failed: %s\n", fs.Transport.Addr(), key, peer.ID(), err)
+			}
+		}(targets[i], stream, pr)
+	}
+
+	go func() {
+		n, err := enc.StreamEncryptContext(ctx, fs.EncryptionKey, plainReader, io.MultiWriter(newFanOut(pipes), checksum))
+		sent = int64(n)
+		trailer = streamTrailer{
+			Checksum: hex.EncodeToString(checksum.Sum(nil)),
+			SHA256:   hex.EncodeToString(plainSum.Sum(nil)),
+		}
+		plainReader.CloseWithError(err)
+		for _, pw := range pipes {
+			pw.CloseWithError(err)
+		}
+		encrypted <- err
+	}()
+
+	var (
+		size int64
+		blob *Blob
+		err  error
+	)
+	r = io.TeeReader(r, io.MultiWriter(plainWriter, plainSum))
+	if local {
+		blob, err = fs.storage.WriteBlob(ctx, fs.ID, key, r)
+		if err == nil {
+			size = blob.Size
+		}
+	} else {
+		size, err = io.Copy(io.Discard, newContextReader(ctx, r))
+	}
+	plainWriter.CloseWithError(err)
+
+	if encryptErr := <-encrypted; err == nil {
+		err = encryptErr
+	}
+	sending.Wait()
+
+	// the local copy is kept only if the whole file was sent
+	if err == nil && local {
+		metadata.Size = size
+		metadata.SHA256 = trailer.SHA256
+		err = fs.storage.Commit(blob, func(Record) (Record, error) {
+			return Record{Key: key, Version: version, Metadata: metadata}, nil
+		})
+	} else if blob != nil {
+		fs.storage.Discard(blob)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] Stored (%d) bytes on %d peers, locally: %t\n", fs.Transport.Addr(), size, len(targets), local)
+
+	// only acknowledgements of exactly what was sent count
+	acked := 0
+	if local {
+		acked++
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, fs.RequestTimeout)
+	defer cancel()
+
+	sum := hex.EncodeToString(checksum.Sum(nil))
+collect:
+	for waiting := len(targets); waiting > 0 && acked < fs.WriteQuorum; waiting-- {
+		select {
+		case res := <-acks:
+			ack, ok := res.Payload.(MessageStoreFileAck)
+			switch {
+			case !ok:
+				fmt.Printf("[%s] Storing (%s): %s\n", fs.Transport.Addr(), key, fs.unexpected(res.From, res.Payload))
+			case ack.Outdated:
+				fmt.Printf("[%s] Storing (%s) on %s: %s\n", fs.Transport.Addr(), key, res.From, ErrOutdated)
+			case len(ack.Error) > 0:
+				fmt.Printf("[%s] Storing (%s) on %s failed: %s\n", fs.Transport.Addr(), key, res.From, ack.Error)
+			case ack.Size != sent || ack.Checksum != sum:
+				fmt.Printf("[%s] Storing (%s) on %s wrote %d bytes (%s), sent %d (%s)\n", fs.Transport.Addr(), key, res.From, ack.Size, ack.Checksum, sent, sum)
+			default:
+				acked++
+			}
+		case <-requestCtx.Done():
+			break collect
+		}
+	}
+
+	return fs.writeQuorum(key, acked)
+}
+
+// writeQuorum checks that enough replicas acknowledged a Store
+func (fs *FileServer) writeQuorum(key string, acked int) error {
+	if acked < fs.WriteQuorum {
+		return fmt.Errorf("[%s] storing (%s): %d of %d replicas acknowledged: %w", fs.Transport.Addr(), key, acked, fs.WriteQuorum, ErrQuorumNotMet)
+	}
+	return nil
+}
+
+// fanOut writes to every writer which did not fail yet,
+// so a single failed replica does not stop the others
+type fanOut struct {
+	writers []io.Writer
+}
+
+func newFanOut(pipes []*io.PipeWriter) *fanOut {
+	f := &fanOut{writers: make([]io.Writer, len(pipes))}
+	for i, pw := range pipes {
+		f.writers[i] = pw
+	}
+	return f
+}
+
+func (f *fanOut) Write(p []byte) (int, error) {
+	for i, w := range f.writers {
+		if w == nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			f.writers[i] = nil
+		}
+	}
+	return len(p), nil
+}
+
+// sendStream writes everything read from r to the stream in chunks,
+// followed by the trailer returned by trailer once r is read, if it is not nil.
+// If r fails, the peer is told to drop what it received.
+func sendStream(stream p2p.Stream, r io.Reader, trailer func() streamTrailer) error {
+	defer stream.Close()
+
+	cw := newChunkWriter(stream)
+	if _, err := io.Copy(cw, r); err != nil {
+		cw.Abort()
+		return err
+	}
+	if trailer == nil {
+		return cw.Close()
+	}
+
+	b, err := json.Marshal(trailer())
+	if err != nil {
+		cw.Abort()
+		return err
+	}
+	return cw.CloseWithTrailer(b)
+}
+
+// replicate sends a replica held by this node to a peer
+// and waits for the peer to acknowledge exactly what was sent
+func (fs *FileServer) replicate(ctx context.Context, peer p2p.Peer, record Record) error {
+	return fs.replicateThrough(ctx, peer, record, nil)
+}
+
+// replicateThrough is replicate which sends the replica
+// through the reader returned by through, if it is not nil.
+// The replica of a tombstone is its deletion.
+func (fs *FileServer) replicateThrough(ctx context.Context, peer p2p.Peer, record Record, through func(io.Reader) io.Reader) error {
+	if record.Deleted {
+		return fs.bury(ctx, peer, record)
+	}
+
+	_, r, err := fs.storage.ReadContext(ctx, fs.ID, record.Key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+	if through != nil {
+		r = through(r)
+	}
+
+	// a file this node wrote itself is kept in plain text, the peer gets it
+	// encrypted under the hashed key like every replica Store sends
+	key, checksum := record.Key, sha256.New()
+	if len(record.Checksum) == 0 {
+		key = enc.HashKey(record.Key)
+
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func(plain io.Reader) {
+			_, err := enc.StreamEncryptContext(ctx, fs.EncryptionKey, plain, pw)
+			pw.CloseWithError(err)
+		}(r)
+		r = pr
+	}
+	r = io.TeeReader(r, checksum)
+
+	requestID := enc.GenerateID()
+	acks := fs.openRequest(requestID, []p2p.Peer{peer})
+	defer fs.closeRequest(requestID)
+
+	stream, err := peer.OpenStream()
 	if err != nil {
 		return err
 	}
 
 	msg := Message{
 		Payload: MessageStoreFile{
-			ID:   fs.ID,
-			Key:  enc.HashKey(key),
-			Size: size + 16,
+			ID:        fs.ID,
+			RequestID: requestID,
+			Key:       key,
+			Version:   record.Version,
+			StreamID:  stream.ID(),
+			Metadata:  record.Metadata,
 		},
 	}
+	if err := fs.send(ctx, peer, &msg); err != nil {
+		stream.Close()
+		return err
+	}
+
+	trailer := func() streamTrailer {
+		return streamTrailer{Checksum: hex.EncodeToString(checksum.Sum(nil)), SHA256: record.SHA256}
+	}
 
-	if err := fs.broadcast(&msg); err != nil {
+	// a peer holding a newer version closes the stream and tells so in its acknowledgement
+	if err := sendStream(stream, r, trailer); err != nil && !errors.Is(err, p2p.ErrStreamClosed) {
 		return err
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, fs.RequestTimeout)
+	defer cancel()
 
+	select {
+	case res := <-acks:
+		ack, ok := res.Payload.(MessageStoreFileAck)
+		if !ok {
+			return fs.unexpected(res.From, res.Payload)
+		}
+		if ack.Outdated {
+			return fmt.Errorf("[%s] replicating (%s) to %s: %w", fs.Transport.Addr(), record.Key, peer.ID(), ErrOutdated)
+		}
+		if len(ack.Error) > 0 {
+			return fmt.Errorf("[%s] replicating (%s) to %s: %s", fs.Transport.Addr(), record.Key, peer.ID(), ack.Error)
+		}
+		if sent := hex.EncodeToString(checksum.Sum(nil)); ack.Checksum != sent {
+			return fmt.Errorf("[%s] replicating (%s) to %s: wrote checksum %s, sent %s", fs.Transport.Addr(), record.Key, peer.ID(), ack.Checksum, sent)
+		}
+		return nil
+	case <-requestCtx.Done():
+		return fmt.Errorf("[%s] waiting for %s to replicate (%s): %w", fs.Transport.Addr(), peer.ID(), record.Key, requestCtx.Err())
+	}
+}
+
+// MessageDeleteFile asks a peer to remove its replica of a file
+// and the copy it wrote itself under the Name the file was stored as,
+// unless they are newer than Version, and to keep a tombstone of Version instead
+type MessageDeleteFile struct {
+	ID        string
+	RequestID string
+	Key       string
+	Name      string
+	Version   int64
+}
+
+// MessageDeleteFileResponse acknowledges a MessageDeleteFile.
+// Deleted is false if the peer held neither a replica nor a copy of its own.
+// Outdated is set if the peer holds a newer version, which it kept.
+// Error is set if the peer failed to delete them.
+type MessageDeleteFileResponse struct {
+	RequestID string
+	Key       string
+	Deleted   bool
+	Outdated  bool
+	Error     string
+}
+
+// Delete removes the file from the local disk and from every peer.
+// It returns the number of replicas the peers reported as removed.
+func (fs *FileServer) Delete(key string) (int, error) {
+	return fs.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete which stops waiting for acknowledgements once the ctx is done
+func (fs *FileServer) DeleteContext(ctx context.Context, key string) (int, error) {
+
+	// the deletion is a version of the file like any other, the tombstones it
+	// leaves keep the replicas which missed it from being written again
+	version := time.Now().UnixNano()
+
+	// this node may hold the file it wrote itself and a replica of it
+	if _, _, err := fs.deleteCopies(ctx, enc.HashKey(key), key, version); err != nil {
+		return 0, err
 	}
 
-	time.Sleep(20 * time.Millisecond)
+	requestCtx, cancel := context.WithTimeout(ctx, fs.RequestTimeout)
+	defer cancel()
 
-	peers := []io.Writer{}
+	requestID := enc.GenerateID()
+	msg := Message{
+		Payload: MessageDeleteFile{
+			ID:        fs.ID,
+			RequestID: requestID,
+			Key:       enc.HashKey(key),
+			Name:      key,
+			Version:   version,
+		},
+	}
+
+	fs.lockPeer.Lock()
+	peers := make([]p2p.Peer, 0, len(fs.peers))
 	for _, peer := range fs.peers {
 		peers = append(peers, peer)
 	}
-	multiwrite := io.MultiWriter(peers...)
-	multiwrite.Write([]byte{p2p.TypeStream})
+	fs.lockPeer.Unlock()
+
+	// every peer the request reached is expected to answer
+	expected := len(peers)
+	responses := fs.openRequest(requestID, peers)
+	defer fs.closeRequest(requestID)
+
+	var errs []error
+	for _, peer := range peers {
+		if err := fs.send(requestCtx, peer, &msg); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", peer.ID(), err))
+			expected--
+		}
+	}
+
+	deleted := 0
+	for ; expected > 0; expected-- {
+		select {
+		case res := <-responses:
+			payload, ok := res.Payload.(MessageDeleteFileResponse)
+			if !ok {
+				errs = append(errs, fs.unexpected(res.From, res.Payload))
+				continue
+			}
+			if len(payload.Error) > 0 {
+				errs = append(errs, fmt.Errorf("%s: %s", res.From, payload.Error))
+				continue
+			}
+			if payload.Deleted {
+				deleted++
+			}
+		case <-requestCtx.Done():
+			return deleted, fmt.Errorf("[%s] waiting for deletion of (%s): %w", fs.Transport.Addr(), key, requestCtx.Err())
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return deleted, fmt.Errorf("[%s] deleting (%s): %w", fs.Transport.Addr(), key, err)
+	}
+
+	fmt.Printf("[%s] Deleted (%s) from %d replicas\n", fs.Transport.Addr(), key, deleted)
+	return deleted, nil
+}
+
+// deleteCopies removes the replica this node holds under hashedKey and the file
+// it wrote itself stored as name, unless they are newer than version.
+// The replica is replaced by a tombstone of version if this node held a copy
+// or owns the key. It reports whether there were any copies
+// and whether a newer version is held.
+func (fs *FileServer) deleteCopies(ctx context.Context, hashedKey string, name string, version int64) (bool, bool, error) {
+	var deleted, outdated bool
+	for _, key := range []string{hashedKey, name} {
+		if len(key) == 0 {
+			continue
+		}
+
+		record, err := fs.storage.Record(fs.ID, key)
+		if err != nil {
+			return deleted, outdated, err
+		}
+		if record.Version > version {
+			outdated = true
+			continue
+		}
+
+		if !fs.storage.PresentContext(ctx, fs.ID, key) {
+			continue
+		}
+		if err := fs.storage.DeleteContext(ctx, fs.ID, key); err != nil {
+			return deleted, outdated, err
+		}
+		deleted = true
+	}
+
+	if outdated {
+		return deleted, outdated, nil
+	}
+
+	// a deleted file is not announced anymore
+	fs.dht.Unprovide(dht.NewID(hashedKey))
+	if !deleted && !fs.owns(fs.ID, hashedKey) {
+		return deleted, outdated, nil
+	}
+
+	tombstone := Record{Key: hashedKey, Version: version, Metadata: Metadata{Name: name}}
+	return deleted, outdated, fs.storage.Tombstone(fs.ID, tombstone)
+}
 
-	n, err := enc.StreamEncrypt(fs.EncryptionKey, fileBuffer, multiwrite)
+// bury sends a peer the tombstone of a deleted replica
+// and waits for the peer to delete its copies
+func (fs *FileServer) bury(ctx context.Context, peer p2p.Peer, record Record) error {
+	res, err := fs.request(ctx, peer, func(requestID string) any {
+		return MessageDeleteFile{
+			ID:        fs.ID,
+			RequestID: requestID,
+			Key:       record.Key,
+			Name:      record.Name,
+			Version:   record.Version,
+		}
+	})
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] Received and written (%d) bytes to disk\n", fs.Transport.Addr(), n)
-
+	payload, ok := res.(MessageDeleteFileResponse)
+	if !ok {
+		return fs.unexpected(peer.ID(), res)
+	}
+	if payload.Outdated {
+		return fmt.Errorf("[%s] deleting (%s) on %s: %w", fs.Transport.Addr(), record.Key, peer.ID(), ErrOutdated)
+	}
+	if len(payload.Error) > 0 {
+		return fmt.Errorf("[%s] deleting (%s) on %s: %s", fs.Transport.Addr(), record.Key, peer.ID(), payload.Error)
+	}
 	return nil
+}
+
+// owners returns the connected peers which own key by the hash ring
+// and whether this node is an owner as well
+func (fs *FileServer) owners(key string) ([]p2p.Peer, bool) {
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
 
+	var (
+		peers []p2p.Peer
+		local bool
+	)
+	for _, id := range fs.ring.Owners(enc.HashKey(key), fs.ReplicationFactor) {
+		if id == fs.ID {
+			local = true
+			continue
+		}
+		if peer, ok := fs.peers[id]; ok {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers, local
+}
+
+// owns reports whether the node id is an owner of a replica stored under hashedKey
+func (fs *FileServer) owns(id string, hashedKey string) bool {
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
+
+	return slices.Contains(fs.ring.Owners(hashedKey, fs.ReplicationFactor), id)
+}
+
+func (fs *FileServer) peer(id string) (p2p.Peer, bool) {
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
+
+	peer, ok := fs.peers[id]
+	return peer, ok
 }
 
+// request sends the message built for a new request to a peer and waits for its response
+func (fs *FileServer) request(ctx context.Context, peer p2p.Peer, payload func(requestID string) any) (any, error) {
+	ctx, cancel := context.WithTimeout(ctx, fs.RequestTimeout)
+	defer cancel()
+
+	requestID := enc.GenerateID()
+	responses := fs.openRequest(requestID, []p2p.Peer{peer})
+	defer fs.closeRequest(requestID)
+
+	if err := fs.send(ctx, peer, &Message{Payload: payload(requestID)}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-responses:
+		return res.Payload, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("[%s] waiting for node %s: %w", fs.Transport.Addr(), peer.ID(), ctx.Err())
+	}
+}
+
+// unexpected returns the error for the response of a peer
+// which is not of the message type the request is answered with
+func (fs *FileServer) unexpected(from string, payload any) error {
+	return fmt.Errorf("[%s] %T from %s: %w", fs.Transport.Addr(), payload, from, ErrUnexpectedResponse)
+}
+
+// openRequest registers a request sent to peers and returns
+// the channel on which their responses are delivered
+func (fs *FileServer) openRequest(id string, peers []p2p.Peer) <-chan response {
+	fs.lockRequests.Lock()
+	defer fs.lockRequests.Unlock()
+
+	req := &pendingRequest{
+		peers:     make(map[string]bool, len(peers)),
+		responses: make(chan response, len(peers)),
+	}
+	for _, peer := range peers {
+		req.peers[peer.ID()] = true
+	}
+	fs.requests[id] = req
+	return req.responses
+}
+
+func (fs *FileServer) closeRequest(id string) {
+	fs.lockRequests.Lock()
+	defer fs.lockRequests.Unlock()
+
+	delete(fs.requests, id)
+}
+
+// resolveRequest hands a response to the request waiting on it.
+// It reports false if the request is unknown or was already closed,
+// or if it was not sent to the peer or the peer answered it already.
+func (fs *FileServer) resolveRequest(id string, res response) bool {
+	fs.lockRequests.Lock()
+	defer fs.lockRequests.Unlock()
+
+	req, ok := fs.requests[id]
+	if !ok || !req.peers[res.From] {
+		return false
+	}
+	delete(req.peers, res.From)
+
+	select {
+	case req.responses <- res:
+		return true
+	default:
+		return false
+	}
+}
+
+// NodeInfo describes this node to its peers during the handshake
+func (fs *FileServer) NodeInfo() p2p.NodeInfo {
+	return p2p.NodeInfo{
+		ID:         fs.ID,
+		ListenAddr: fs.Transport.Addr(),
+		Version:    p2p.ProtocolVersion,
+		Features:   []string{p2p.FeatureStreams},
+	}
+}
+
+// PeerStatus registers a peer under its node ID
 func (fs *FileServer) PeerStatus(p p2p.Peer) error {
 	fs.lockPeer.Lock()
 	defer fs.lockPeer.Unlock()
 
-	fs.peers[p.RemoteAddr().String()] = p
-	log.Printf("Connected with remote %s", p.RemoteAddr())
+	// Two nodes dialing each other at the same time end up with two connections.
+	// Both ends keep the one dialed by the node with the smaller ID, so a message
+	// and the stream it refers to always travel over the same connection.
+	//
+	// A connection dialed for calls only is not needed anymore once
+	// the calls went over another connection to the same node
+	addr := p.Info().ListenAddr
+	call := p.Outbound() && fs.dialed(addr)
+	if call && !fs.dialing[addr] {
+		return fmt.Errorf("[%s] calls to node %s were made without the connection", fs.Transport.Addr(), p.ID())
+	}
+
+	existing, ok := fs.peers[p.ID()]
+	if ok && existing != p {
+		if fs.preferred(existing) && !fs.preferred(p) {
+			return fmt.Errorf("[%s] already connected with node %s", fs.Transport.Addr(), p.ID())
+		}
+		existing.Close()
+	}
+	_, calls := fs.calls[existing]
+	delete(fs.calls, existing)
+
+	fs.peers[p.ID()] = p
+	fs.dht.AddContact(contact(p))
+	fs.gossip.Join(gossip.Member{ID: p.ID(), Addr: p.Info().ListenAddr})
+	fs.notifyConnection(p.Info().ListenAddr)
+	log.Printf("[%s] Connected with node %s at %s", fs.Transport.Addr(), p.ID(), p.RemoteAddr())
+
+	// A node dialed for calls only is no peer of this node. The other end can't tell
+	// such a connection from any other, so it replaces a peer like a disconnect would.
+	if call {
+		fs.calls[p] = 0
+		if ok && !calls {
+			fs.leave(p.ID())
+		}
+		return nil
+	}
 
+	fs.join(p)
 	return nil
 }
 
+// join places files on a peer from now on, caller holds lockPeer
+func (fs *FileServer) join(p p2p.Peer) {
+	fs.ring.Add(p.ID())
+	fs.members.Add(p.ID())
+	fs.scheduleRebalance()
+
+	go fs.handoff(p)
+	go fs.exchangePeers(fs.ctx, p)
+}
+
+// leave stops placing files on a node which is no peer anymore, caller holds lockPeer
+func (fs *FileServer) leave(id string) {
+	fs.ring.Remove(id)
+	fs.scheduleRebalance()
+	fs.replacePeer()
+}
+
+// preferred reports whether the connection to a peer was dialed
+// by the node with the smaller ID of the two
+func (fs *FileServer) preferred(p p2p.Peer) bool {
+	return p.Outbound() == (fs.ID < p.ID())
+}
+
+// PeerDisconnect removes a dropped peer, unless it was
+// already replaced by a newer connection to the same node
+func (fs *FileServer) PeerDisconnect(p p2p.Peer) {
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
+
+	_, calls := fs.calls[p]
+	delete(fs.calls, p)
+
+	if fs.peers[p.ID()] == p {
+		delete(fs.peers, p.ID())
+		if !calls {
+			fs.leave(p.ID())
+		}
+	}
+	fs.notifyConnection(p.Info().ListenAddr)
+	log.Printf("[%s] Disconnected from node %s at %s", fs.Transport.Addr(), p.ID(), p.RemoteAddr())
+}
+
 func (fs *FileServer) Start() error {
+	if err := fs.storage.CleanPartial(); err != nil {
+		return err
+	}
+
 	if err := fs.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
 
-	fs.listedNodeNetwork()
+	fs.connectNodes()
+	go fs.antiEntropy()
+	go fs.rebalancer()
+	if fs.GossipInterval > 0 {
+		fs.gossip.ProbeInterval = fs.GossipInterval
+	}
+	go fs.gossip.Run(fs.ctx)
+	go fs.dht.Run(fs.ctx)
 	fs.loop()
 
 	return nil
 }
 
 func (fs *FileServer) Stop() {
-	close(fs.quitChannel)
+	fs.stopOnce.Do(func() {
+		fs.cancel()
+		close(fs.quitChannel)
+	})
 }
 
 func (fs *FileServer) loop() {
@@ -189,34 +1414,104 @@ func (fs *FileServer) loop() {
 			var m Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&m); err != nil {
 				log.Printf("Decoding Error: %s", err)
+				continue
 			}
 
-			if err := fs.handleMessage(rpc.From, &m); err != nil {
-				log.Printf("Handle Message Error: %s", err)
-			}
+			// a handler may be busy with a stream for a while,
+			// so it must not hold up the messages behind it
+			go func(from string) {
+				if err := fs.handleMessage(fs.ctx, from, &m); err != nil {
+					log.Printf("Handle Message Error: %s", err)
+				}
+			}(rpc.From)
 		case <-fs.quitChannel:
 			return
 		}
 	}
 }
 
-func (fs *FileServer) handleMessage(from string, m *Message) error {
+func (fs *FileServer) handleMessage(ctx context.Context, from string, m *Message) error {
 	switch payload := m.Payload.(type) {
 	case MessageStoreFile:
-		return fs.handleMessageStoreFile(from, payload)
+		return fs.handleMessageStoreFile(ctx, from, payload)
+	case MessageStoreFileAck:
+		return fs.handleMessageStoreFileAck(from, payload)
 	case MessageGetFile:
-		return fs.handleMessageGetFile(from, payload)
+		return fs.handleMessageGetFile(ctx, from, payload)
+	case MessageGetFileResponse:
+		return fs.handleMessageGetFileResponse(from, payload)
+	case MessageDeleteFile:
+		return fs.handleMessageDeleteFile(ctx, from, payload)
+	case MessageDeleteFileResponse:
+		return fs.handleMessageDeleteFileResponse(from, payload)
+	case MessageGossipPing:
+		return fs.handleMessageGossipPing(ctx, from, payload)
+	case MessageGossipPingReq:
+		return fs.handleMessageGossipPingReq(ctx, from, payload)
+	case MessageGossipAck:
+		return fs.handleMessageResponse(from, payload.RequestID, payload)
+	case MessagePeerExchange:
+		return fs.handleMessagePeerExchange(ctx, from, payload)
+	case MessagePeerExchangeResponse:
+		return fs.handleMessageResponse(from, payload.RequestID, payload)
+	case MessageLeave:
+		return fs.handleMessageLeave(from)
+	case MessageListFiles:
+		return fs.handleMessageListFiles(ctx, from, payload)
+	case MessageListFilesResponse:
+		return fs.handleMessageResponse(from, payload.RequestID, payload)
+	case MessageStatFile:
+		return fs.handleMessageStatFile(ctx, from, payload)
+	case MessageStatFileResponse:
+		return fs.handleMessageResponse(from, payload.RequestID, payload)
+	case MessageRepairFile:
+		return fs.handleMessageRepairFile(ctx, from, payload)
+	case MessageSyncTree:
+		return fs.handleMessageSyncTree(ctx, from, payload)
+	case MessageSyncRecords:
+		return fs.handleMessageSyncRecords(ctx, from, payload)
+	case MessageSyncTreeResponse:
+		return fs.handleMessageResponse(from, payload.RequestID, payload)
+	case MessageFindNode:
+		return fs.handleMessageFindNode(ctx, from, payload)
+	case MessageFindNodeResponse:
+		return fs.handleMessageResponse(from, payload.RequestID, payload)
+	case MessageFindValue:
+		return fs.handleMessageFindValue(ctx, from, payload)
+	case MessageFindValueResponse:
+		return fs.handleMessageResponse(from, payload.RequestID, payload)
+	case MessageAddProvider:
+		return fs.handleMessageAddProvider(ctx, from, payload)
+	case MessageAddProviderResponse:
+		return fs.handleMessageResponse(from, payload.RequestID, payload)
 	}
 	return nil
 }
 
-func (fs *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	if !fs.storage.Present(fs.ID, msg.Key) {
-		return fmt.Errorf("[%s] no such file (%s) found on local disk", fs.Transport.Addr(), msg.Key)
+func (fs *FileServer) handleMessageGetFile(ctx context.Context, from string, msg MessageGetFile) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not found in map", from)
+	}
+
+	res := MessageGetFileResponse{
+		RequestID: msg.RequestID,
+		Key:       msg.Key,
+	}
+
+	if !fs.storage.PresentContext(ctx, fs.ID, msg.Key) {
+		fmt.Printf("[%s] No file (%s) found on local disk\n", fs.Transport.Addr(), msg.Key)
+
+		// the deletion of the file is a version the asking node has to know of
+		if record, err := fs.storage.Record(fs.ID, msg.Key); err == nil && record.Deleted {
+			res.Deleted = true
+			res.Version = record.Version
+		}
+		return fs.send(ctx, peer, &Message{Payload: res})
 	}
 
 	fmt.Printf("[%s] File (%s) found. Sending over the network\n", fs.Transport.Addr(), msg.Key)
-	fileSize, r, err := fs.storage.Read(fs.ID, msg.Key)
+	fileSize, r, err := fs.storage.ReadContext(ctx, fs.ID, msg.Key)
 	if err != nil {
 		return err
 	}
@@ -225,71 +1520,229 @@ func (fs *FileServer) handleMessageGetFile(from string, msg MessageGetFile) erro
 		defer rc.Close()
 	}
 
-	peer, ok := fs.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not found in map", from)
+	record, err := fs.storage.Record(fs.ID, msg.Key)
+	if err != nil {
+		return err
 	}
 
-	// First byte -> Type of stream
-	// Second byte -> Size of stream
-	peer.Send([]byte{p2p.TypeStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
+	stream, err := peer.OpenStream()
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] written (%d) over the network to %s\n", fs.Transport.Addr(), n, from)
+	res.Found = true
+	res.Size = fileSize
+	res.Version = record.Version
+	res.Checksum = record.Checksum
+	res.Metadata = record.Metadata
+	res.StreamID = stream.ID()
+	if err := fs.send(ctx, peer, &Message{Payload: res}); err != nil {
+		stream.Close()
+		return err
+	}
+
+	if err := sendStream(stream, r, nil); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] written (%d) over the network to %s\n", fs.Transport.Addr(), fileSize, from)
 	return nil
 }
 
-func (fs *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
+func (fs *FileServer) handleMessageGetFileResponse(from string, msg MessageGetFileResponse) error {
+	if fs.resolveRequest(msg.RequestID, response{From: from, Payload: msg}) {
+		return nil
+	}
 
-	peer, ok := fs.peers[from]
+	// Nobody is waiting for this response anymore, but a found file
+	// is already on its way and its stream is closed to stop it
+	if msg.Found {
+		peer, ok := fs.peer(from)
+		if !ok {
+			return fmt.Errorf("peer (%s) not found", from)
+		}
+
+		if stream, err := peer.AcceptStream(msg.StreamID); err == nil {
+			stream.Close()
+		}
+	}
+
+	return fmt.Errorf("[%s] no pending request (%s) for response from %s", fs.Transport.Addr(), msg.RequestID, from)
+}
+
+func (fs *FileServer) handleMessageDeleteFile(ctx context.Context, from string, msg MessageDeleteFile) error {
+	peer, ok := fs.peer(from)
 	if !ok {
 		return fmt.Errorf("peer (%s) not found", from)
 	}
 
-	n, err := fs.storage.writeStream(fs.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	res := MessageDeleteFileResponse{
+		RequestID: msg.RequestID,
+		Key:       msg.Key,
+	}
+
+	deleted, outdated, err := fs.deleteCopies(ctx, msg.Key, msg.Name, msg.Version)
+	res.Deleted, res.Outdated = deleted, outdated
 	if err != nil {
-		return err
+		res.Error = err.Error()
 	}
-	fmt.Printf("[%s] Written %d bytes to disk\n", fs.Transport.Addr(), n)
-	peer.CloseStream()
 
-	return nil
+	return fs.send(ctx, peer, &Message{Payload: res})
 }
 
-func (fs *FileServer) listedNodeNetwork() error {
+func (fs *FileServer) handleMessageDeleteFileResponse(from string, msg MessageDeleteFileResponse) error {
+	if fs.resolveRequest(msg.RequestID, response{From: from, Payload: msg}) {
+		return nil
+	}
+	return fmt.Errorf("[%s] no pending request (%s) for response from %s", fs.Transport.Addr(), msg.RequestID, from)
+}
 
-	for _, addr := range fs.NodeList {
+func (fs *FileServer) handleMessageStoreFile(ctx context.Context, from string, msg MessageStoreFile) error {
 
-		if len(addr) == 0 {
-			continue
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	stream, err := peer.AcceptStream(msg.StreamID)
+	if err != nil {
+		return err
+	}
+
+	var (
+		checksum = sha256.New()
+		blob     *Blob
+		trailer  streamTrailer
+	)
+
+	// an older version than the one held is not even received
+	existing, err := fs.storage.Record(fs.ID, msg.Key)
+	outdated := err == nil && msg.Version < existing.Version
+	switch {
+	case err != nil:
+	case outdated:
+		err = ErrOutdated
+	case fs.decommissioned.Load():
+		err = ErrDecommissioned
+	default:
+		cr := newChunkReader(stream)
+		blob, err = fs.storage.WriteBlob(ctx, fs.ID, msg.Key, io.TeeReader(cr, checksum))
+		if err == nil {
+			trailer, err = readTrailer(cr)
+		}
+	}
+	stream.Close()
+
+	var n int64
+	if blob != nil {
+		n = blob.Size
+	}
+	sum := hex.EncodeToString(checksum.Sum(nil))
+	if err == nil {
+		err = verifyChecksum(msg.Key, "replica", trailer.Checksum, sum)
+	}
+
+	// the file is kept for the disconnected owners before it is acknowledged
+	for _, owner := range msg.Hints {
+		if err == nil {
+			err = fs.storage.WriteHint(fs.ID, Hint{Owner: owner, Key: msg.Key})
 		}
-		go func(addr string) {
-			log.Printf("[%s] Attempting to connect %s\n", fs.Transport.Addr(), addr)
-			if err := fs.Transport.Dial(addr); err != nil {
-				log.Println("Dial Error ", err)
-			} else {
-				log.Printf("Connected to %s", addr)
+	}
+
+	if err == nil {
+		err = fs.storage.Commit(blob, func(existing Record) (Record, error) {
+			// a newer version may have been written while this one was received
+			if msg.Version < existing.Version {
+				outdated = true
+				return existing, ErrOutdated
+			}
+
+			// a replica keeps the creation of the first version it held
+			metadata := msg.Metadata
+			if !existing.Created.IsZero() && existing.Created.Before(metadata.Created) {
+				metadata.Created = existing.Created
 			}
-		}(addr)
-		time.Sleep(time.Second)
+			if metadata.Size == 0 {
+				metadata.Size = max(n-enc.Overhead, 0)
+			}
+			if len(metadata.SHA256) == 0 {
+				metadata.SHA256 = trailer.SHA256
+			}
+			return Record{Key: msg.Key, Version: msg.Version, Checksum: sum, Metadata: metadata}, nil
+		})
+	} else if blob != nil {
+		fs.storage.Discard(blob)
+	}
+
+	ack := MessageStoreFileAck{
+		RequestID: msg.RequestID,
+		Key:       msg.Key,
+		Size:      n,
+		Checksum:  sum,
+		Outdated:  outdated,
+	}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	if sendErr := fs.send(ctx, peer, &Message{Payload: ack}); err == nil || outdated {
+		err = sendErr
+	}
+	if err != nil || outdated {
+		return err
+	}
+	fmt.Printf("[%s] Written %d bytes to disk\n", fs.Transport.Addr(), n)
+
+	// nodes which are not connected to the owners find this replica through the DHT
+	if err := fs.dht.Provide(ctx, dht.NewID(msg.Key)); err != nil {
+		return fmt.Errorf("[%s] announcing (%s): %w", fs.Transport.Addr(), msg.Key, err)
 	}
 
 	return nil
 }
 
-func (fs *FileServer) broadcast(msg *Message) error {
+// handleMessageResponse routes the response to a request sent with request
+func (fs *FileServer) handleMessageResponse(from, requestID string, payload any) error {
+	if fs.resolveRequest(requestID, response{From: from, Payload: payload}) {
+		return nil
+	}
+	return fmt.Errorf("[%s] no pending request (%s) for response from %s", fs.Transport.Addr(), requestID, from)
+}
+
+func (fs *FileServer) handleMessageStoreFileAck(from string, msg MessageStoreFileAck) error {
+	if fs.resolveRequest(msg.RequestID, response{From: from, Payload: msg}) {
+		return nil
+	}
+	return fmt.Errorf("[%s] no pending request (%s) for acknowledgement from %s", fs.Transport.Addr(), msg.RequestID, from)
+}
+
+func (fs *FileServer) send(ctx context.Context, peer p2p.Peer, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	msgBuffer := new(bytes.Buffer)
 	if err := gob.NewEncoder(msgBuffer).Encode(msg); err != nil {
 		return err
 	}
 
+	return peer.Send(msgBuffer.Bytes())
+}
+
+func (fs *FileServer) broadcast(ctx context.Context, msg *Message) error {
+
+	msgBuffer := new(bytes.Buffer)
+	if err := gob.NewEncoder(msgBuffer).Encode(msg); err != nil {
+		return err
+	}
+
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
+
 	for _, peer := range fs.peers {
-		peer.Send([]byte{p2p.TypeMessage})
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		if err := peer.Send(msgBuffer.Bytes()); err != nil {
 			return err
 		}
@@ -300,5 +1753,9 @@ func (fs *FileServer) broadcast(msg *Message) error {
 
 func init() {
 	gob.Register(MessageStoreFile{})
+	gob.Register(MessageStoreFileAck{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetFileResponse{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageDeleteFileResponse{})
 }
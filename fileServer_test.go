@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/metrics"
+	"testing"
+	"time"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+	p2p "github.com/palSagnik/Distributed-File-Storage/Peer-To-Peer"
+)
+
+func TestGetNotFound(t *testing.T) {
+	fs := makeNewServer(":3000", "")
+	defer teardown(t, fs.storage)
+
+	if _, err := fs.Get("nosuchfile"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("wanted %s, got %v", ErrFileNotFound, err)
+	}
+}
+
+func TestNewFileServerNodeID(t *testing.T) {
+	key := enc.NewNodeKey()
+	transport := p2p.NewTCPTransport(p2p.TCPTransportConfig{ListenAddress: ":3047"})
+
+	fs, err := NewFileServer(FileServerConfig{NodeKey: key, StorageRoot: t.TempDir(), Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := p2p.NodeIDFromKey(key.Public().(ed25519.PublicKey)); fs.ID != want {
+		t.Errorf("wanted the id %s derived from the key, got %s", want, fs.ID)
+	}
+	if !fs.NodeInfo().HasFeature(p2p.FeatureStreams) {
+		t.Errorf("wanted the node to announce %q, got %v", p2p.FeatureStreams, fs.NodeInfo().Features)
+	}
+
+	for _, config := range []FileServerConfig{
+		{ID: enc.GenerateID(), NodeKey: key, Transport: transport},
+		{ID: fs.ID, Transport: transport},
+	} {
+		if _, err := NewFileServer(config); err == nil {
+			t.Errorf("expected the id %s to be refused", config.ID)
+		}
+	}
+}
+
+func TestDeleteLocal(t *testing.T) {
+	fs := makeNewServer(":3001", "")
+	defer teardown(t, fs.storage)
+
+	key := "fooandbar"
+	if _, err := fs.storage.Write(fs.ID, key, bytes.NewReader([]byte("gone soon"))); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := fs.Delete(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("wanted 0 replicas deleted without peers, got %d", n)
+	}
+	if fs.storage.Present(fs.ID, key) {
+		t.Errorf("expected %s to be deleted from local disk", key)
+	}
+}
+
+func TestDeleteReplicas(t *testing.T) {
+	peer := makeNewServer(":3048", "")
+	defer teardown(t, peer.storage)
+	go peer.Start()
+	defer peer.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	origin := makeNewServer(":3049", ":3048")
+	origin.WriteQuorum = 2
+	defer teardown(t, origin.storage)
+	go origin.Start()
+	defer origin.Stop()
+	waitForPeers(t, origin, 1)
+
+	key := "deletedeverywhere"
+	if err := origin.Store(key, bytes.NewReader([]byte("replicated"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// both nodes hold a copy they wrote themselves and a replica
+	if _, err := origin.storage.Write(origin.ID, enc.HashKey(key), bytes.NewReader([]byte("replica"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.storage.Write(peer.ID, key, bytes.NewReader([]byte("written by the peer"))); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := origin.Delete(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("wanted 1 peer to delete the file, got %d", n)
+	}
+
+	for _, fs := range []*FileServer{origin, peer} {
+		for _, k := range []string{key, enc.HashKey(key)} {
+			if fs.storage.Present(fs.ID, k) {
+				t.Errorf("expected (%s) to be deleted from %s", k, fs.Transport.Addr())
+			}
+		}
+	}
+}
+
+func TestStoreReplicationFactor(t *testing.T) {
+	var nodes []*FileServer
+	for _, addr := range []string{":3006", ":3007"} {
+		fs := makeNewServer(addr, "")
+		defer teardown(t, fs.storage)
+		go fs.Start()
+		defer fs.Stop()
+		nodes = append(nodes, fs)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	origin := makeNewServer(":3008", ":3006", ":3007")
+	origin.ReplicationFactor = 2
+	defer teardown(t, origin.storage)
+	go origin.Start()
+	defer origin.Stop()
+	waitForPeers(t, origin, 2)
+
+	key := "placedfile"
+	data := []byte("only on two nodes")
+	if err := origin.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replicas are written in the background
+	replicas := func() int {
+		n := 0
+		if origin.storage.Present(origin.ID, key) {
+			n++
+		}
+		for _, fs := range nodes {
+			if fs.storage.Present(fs.ID, enc.HashKey(key)) {
+				n++
+			}
+		}
+		return n
+	}
+	deadline := time.Now().Add(time.Second)
+	for replicas() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := replicas(); n != 2 {
+		t.Fatalf("wanted the file on 2 nodes, got %d", n)
+	}
+
+	origin.storage.Delete(origin.ID, key)
+	r, err := origin.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("wanted %s, got %s", data, b)
+	}
+}
+
+func TestStoreFailedReplica(t *testing.T) {
+	var peers []*FileServer
+	for _, addr := range []string{":3050", ":3051"} {
+		fs := makeNewServer(addr, "")
+		defer teardown(t, fs.storage)
+		go fs.Start()
+		defer fs.Stop()
+		peers = append(peers, fs)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	origin := makeNewServer(":3052", ":3050", ":3051")
+	origin.WriteQuorum = 2
+	defer teardown(t, origin.storage)
+	go origin.Start()
+	defer origin.Stop()
+	waitForPeers(t, origin, 2)
+
+	// the failing peer closes its stream before the file fits in its window
+	failing, healthy := peers[0], peers[1]
+	failing.decommissioned.Store(true)
+
+	key := "onefailing"
+	data := bytes.Repeat([]byte("replicated to the healthy peer "), 64<<10)
+	if err := origin.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !origin.storage.Present(origin.ID, key) {
+		t.Errorf("expected the local copy to be kept")
+	}
+	if !healthy.storage.Present(healthy.ID, enc.HashKey(key)) {
+		t.Errorf("expected the replica on %s", healthy.ID)
+	}
+}
+
+func TestStoreOutdated(t *testing.T) {
+	peer := makeNewServer(":3053", "")
+	defer teardown(t, peer.storage)
+	go peer.Start()
+	defer peer.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	fs := makeNewServer(":3054", ":3053")
+	defer teardown(t, fs.storage)
+	go fs.Start()
+	defer fs.Stop()
+	waitForPeers(t, fs, 1)
+
+	key := enc.HashKey("outdated")
+	newer := plantReplica(t, peer, key, bytes.Repeat([]byte("newer"), 64<<10), 2)
+	older := plantReplica(t, fs, key, bytes.Repeat([]byte("older"), 64<<10), 1)
+
+	p, _ := fs.peer(peer.ID)
+	if err := fs.replicate(context.Background(), p, older); !errors.Is(err, ErrOutdated) {
+		t.Errorf("wanted %s, got %v", ErrOutdated, err)
+	}
+	if got, err := peer.storage.Record(peer.ID, key); err != nil || got != newer {
+		t.Errorf("wanted the newer replica kept as %+v, got %+v (%v)", newer, got, err)
+	}
+}
+
+func TestStoreWriteQuorum(t *testing.T) {
+	fs := makeNewServer(":3012", "")
+	fs.WriteQuorum = 2
+	defer teardown(t, fs.storage)
+
+	// a node on its own is a single replica
+	err := fs.Store("lonelyfile", bytes.NewReader([]byte("nobody to ack")))
+	if !errors.Is(err, ErrQuorumNotMet) {
+		t.Errorf("wanted %s, got %v", ErrQuorumNotMet, err)
+	}
+
+	peer := makeNewServer(":3013", "")
+	defer teardown(t, peer.storage)
+	go peer.Start()
+	defer peer.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	fs.NodeList = []string{":3013"}
+	go fs.Start()
+	defer fs.Stop()
+	waitForPeers(t, fs, 1)
+
+	// the replica is written by the time Store returns
+	if err := fs.Store("ackedfile", bytes.NewReader([]byte("acknowledged"))); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.storage.Present(peer.ID, enc.HashKey("ackedfile")) {
+		t.Errorf("expected the replica on %s", peer.ID)
+	}
+}
+
+func TestGetNewestVersion(t *testing.T) {
+	peer := makeNewServer(":3014", "")
+	defer teardown(t, peer.storage)
+	go peer.Start()
+	defer peer.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	fs := makeNewServer(":3015", ":3014")
+	fs.WriteQuorum, fs.ReadQuorum = 2, 2
+	defer teardown(t, fs.storage)
+	go fs.Start()
+	defer fs.Stop()
+	waitForPeers(t, fs, 1)
+
+	key := "changingfile"
+	if err := fs.Store(key, bytes.NewReader([]byte("old"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replica of the peer was replaced by a newer version
+	data := []byte("new")
+	ciphertext := new(bytes.Buffer)
+	if _, err := enc.StreamEncrypt(fs.EncryptionKey, bytes.NewReader(data), ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.storage.Write(peer.ID, enc.HashKey(key), ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.storage.WriteRecord(peer.ID, Record{Key: enc.HashKey(key), Version: time.Now().UnixNano()}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("wanted %s, got %s", data, b)
+	}
+
+	// without the peer, the read quorum can't be met
+	peer.Transport.Close()
+	waitForPeers(t, fs, 0)
+	if _, err := fs.Get(key); !errors.Is(err, ErrQuorumNotMet) {
+		t.Errorf("wanted %s, got %v", ErrQuorumNotMet, err)
+	}
+}
+
+func TestGetDeleted(t *testing.T) {
+	var replicas []*FileServer
+	for _, addr := range []string{":3062", ":3063"} {
+		fs := makeNewServer(addr, "")
+		defer teardown(t, fs.storage)
+		go fs.Start()
+		defer fs.Stop()
+		replicas = append(replicas, fs)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	fs := makeNewServer(":3064", ":3062", ":3063")
+	fs.WriteQuorum, fs.ReadQuorum = 3, 2
+	defer teardown(t, fs.storage)
+	go fs.Start()
+	defer fs.Stop()
+	waitForPeers(t, fs, 2)
+
+	key := "deletedfile"
+	if err := fs.Store(key, bytes.NewReader([]byte("deleted soon"))); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := replicas[1]
+	hashedKey := enc.HashKey(key)
+	record, err := stale.storage.Record(stale.ID, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := stale.storage.Read(stale.ID, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range replicas {
+		waitForPeers(t, r, 2)
+	}
+
+	// the tombstones of the peers win over the replica which missed the deletion
+	plantReplica(t, stale, hashedKey, replica, record.Version)
+	if _, err := stale.Get(key); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("wanted %s, got %v", ErrFileNotFound, err)
+	}
+	if stale.storage.Present(stale.ID, hashedKey) {
+		t.Errorf("wanted the stale replica deleted")
+	}
+
+	// and so does the tombstone this node keeps, which repairs the stale replica
+	plantReplica(t, stale, hashedKey, replica, record.Version)
+	if _, err := fs.Get(key); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("wanted %s, got %v", ErrFileNotFound, err)
+	}
+	for _, k := range []string{key, hashedKey} {
+		if fs.storage.Present(fs.ID, k) {
+			t.Errorf("wanted (%s) to stay deleted", k)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for stale.storage.Present(stale.ID, hashedKey) {
+		if time.Now().After(deadline) {
+			t.Fatal("wanted the stale replica deleted by the repair")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// idPeer is a peer known only by its ID
+type idPeer struct {
+	p2p.Peer
+	id string
+}
+
+func (p idPeer) ID() string {
+	return p.id
+}
+
+func TestResolveRequest(t *testing.T) {
+	fs := makeNewServer(":3065", "")
+	defer teardown(t, fs.storage)
+
+	requestID := enc.GenerateID()
+	asked := idPeer{id: enc.GenerateID()}
+	responses := fs.openRequest(requestID, []p2p.Peer{asked})
+	defer fs.closeRequest(requestID)
+
+	if fs.resolveRequest(requestID, response{From: enc.GenerateID()}) {
+		t.Errorf("wanted the response of a peer which was not asked refused")
+	}
+	if !fs.resolveRequest(requestID, response{From: asked.ID(), Payload: MessageStatFileResponse{}}) {
+		t.Fatal("wanted the response of the peer asked delivered")
+	}
+	if fs.resolveRequest(requestID, response{From: asked.ID()}) {
+		t.Errorf("wanted a second response of the peer refused")
+	}
+
+	if res := <-responses; res.From != asked.ID() {
+		t.Errorf("wanted the response from %s, got %s", asked.ID(), res.From)
+	}
+}
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// BenchmarkStore streams files of growing size to a single peer.
+// The peak heap stays flat as the file size grows.
+func BenchmarkStore(b *testing.B) {
+	receiver := makeNewServer(":3002", "")
+	defer teardown(b, receiver.storage)
+	go receiver.Start()
+	defer receiver.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	sender := makeNewServer(":3003", ":3002")
+	defer teardown(b, sender.storage)
+	go sender.Start()
+	defer sender.Stop()
+
+	waitForPeers(b, sender, 1)
+
+	for _, size := range []int64{1 << 20, 16 << 20, 64 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+
+			runtime.GC()
+			stop := make(chan struct{})
+			peak := peakHeap(stop)
+
+			for i := 0; i < b.N; i++ {
+				if err := sender.Store("benchmark", io.LimitReader(zeroReader{}, size)); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			close(stop)
+			b.ReportMetric(float64(<-peak), "peak-heap-B")
+		})
+	}
+}
+
+// peakHeap samples the bytes held by heap objects until stop is closed
+// and then delivers the largest sample
+func peakHeap(stop <-chan struct{}) <-chan uint64 {
+	peak := make(chan uint64, 1)
+
+	go func() {
+		sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+
+		var highest uint64
+		for {
+			metrics.Read(sample)
+			highest = max(highest, sample[0].Value.Uint64())
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				peak <- highest
+				return
+			}
+		}
+	}()
+
+	return peak
+}
+
+func TestGetCorrupted(t *testing.T) {
+	holder := makeNewServer(":3045", "")
+	defer teardown(t, holder.storage)
+	go holder.Start()
+	defer holder.Stop()
+
+	origin := makeNewServer(":3046", ":3045")
+	origin.ReplicationFactor = 2
+	origin.WriteQuorum = 2
+	defer teardown(t, origin.storage)
+	go origin.Start()
+	defer origin.Stop()
+	waitForPeers(t, origin, 1)
+
+	key := "checked"
+	data := []byte("verified on every read")
+	if err := origin.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the local copy rots
+	rotten := bytes.Clone(data)
+	rotten[0] ^= 1
+	rot(t, origin.storage, origin.ID, key, rotten)
+	r, err := origin.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("wanted %s reading the local copy, got %v", ErrCorrupted, err)
+	}
+
+	// the replica decrypts to something else than what was stored
+	origin.storage.Delete(origin.ID, key)
+	hashedKey := enc.HashKey(key)
+	record, err := holder.storage.Record(holder.ID, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.SHA256 = hex.EncodeToString(make([]byte, 32))
+	if err := holder.storage.WriteRecord(holder.ID, record); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := origin.Get(key); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("wanted %s downloading the replica, got %v", ErrCorrupted, err)
+	}
+	if origin.storage.Present(origin.ID, key) {
+		t.Errorf("expected the corrupted download not to be kept")
+	}
+
+	// a replica which rotted is not sent
+	record.SHA256 = ""
+	if err := holder.storage.WriteRecord(holder.ID, record); err != nil {
+		t.Fatal(err)
+	}
+	rot(t, holder.storage, holder.ID, hashedKey, make([]byte, 16+len(data)))
+	if _, err := origin.Get(key); err == nil {
+		t.Errorf("expected the rotten replica not to be downloaded")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+
+	dht "github.com/palSagnik/Distributed-File-Storage/DHT"
+	gossip "github.com/palSagnik/Distributed-File-Storage/Gossip"
+)
+
+// MessageGossipPing probes a member, carrying updates about the members
+type MessageGossipPing struct {
+	RequestID string
+	Updates   []gossip.Member
+}
+
+// MessageGossipPingReq asks a member to probe Target on behalf of the sender
+type MessageGossipPingReq struct {
+	RequestID string
+	Target    gossip.Member
+	Updates   []gossip.Member
+}
+
+// MessageGossipAck answers both probes. Error is set if Target could not be reached.
+type MessageGossipAck struct {
+	RequestID string
+	Updates   []gossip.Member
+	Error     string
+}
+
+// gossipNetwork carries the messages of the membership protocol between file servers,
+// connecting to the members which are not peers yet
+type gossipNetwork struct {
+	fs *FileServer
+}
+
+func (n gossipNetwork) Ping(ctx context.Context, to gossip.Member, updates []gossip.Member) ([]gossip.Member, error) {
+	res, err := n.fs.call(ctx, dht.Contact{ID: to.ID, Addr: to.Addr}, func(requestID string) any {
+		return MessageGossipPing{RequestID: requestID, Updates: updates}
+	})
+	return n.ack(to.ID, res, err)
+}
+
+func (n gossipNetwork) PingReq(ctx context.Context, via gossip.Member, target gossip.Member, updates []gossip.Member) ([]gossip.Member, error) {
+	res, err := n.fs.call(ctx, dht.Contact{ID: via.ID, Addr: via.Addr}, func(requestID string) any {
+		return MessageGossipPingReq{RequestID: requestID, Target: target, Updates: updates}
+	})
+	return n.ack(via.ID, res, err)
+}
+
+func (n gossipNetwork) ack(from string, res any, err error) ([]gossip.Member, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	ack, ok := res.(MessageGossipAck)
+	if !ok {
+		return nil, n.fs.unexpected(from, res)
+	}
+	if len(ack.Error) > 0 {
+		return nil, errors.New(ack.Error)
+	}
+	return ack.Updates, nil
+}
+
+// Members returns the view this node has of the cluster, itself included
+func (fs *FileServer) Members() []gossip.Member {
+	return fs.gossip.Members()
+}
+
+// memberChanged closes the connection to a member the cluster declared dead.
+// If the member is still around, it reconnects and refutes that.
+func (fs *FileServer) memberChanged(m gossip.Member) {
+	log.Printf("[%s] Member %s at %s is %s", fs.Transport.Addr(), m.ID, m.Addr, m.State)
+
+	if current, ok := fs.gossip.Member(m.ID); !ok || current.State != gossip.Dead {
+		return
+	}
+	if peer, ok := fs.peer(m.ID); ok {
+		peer.Close()
+	}
+}
+
+func (fs *FileServer) handleMessageGossipPing(ctx context.Context, from string, msg MessageGossipPing) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	res := MessageGossipAck{
+		RequestID: msg.RequestID,
+		Updates:   fs.gossip.HandlePing(msg.Updates),
+	}
+	return fs.send(ctx, peer, &Message{Payload: res})
+}
+
+func (fs *FileServer) handleMessageGossipPingReq(ctx context.Context, from string, msg MessageGossipPingReq) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	res := MessageGossipAck{RequestID: msg.RequestID}
+	updates, err := fs.gossip.HandlePingReq(ctx, msg.Target, msg.Updates)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	res.Updates = updates
+
+	return fs.send(ctx, peer, &Message{Payload: res})
+}
+
+func init() {
+	gob.Register(MessageGossipPing{})
+	gob.Register(MessageGossipPingReq{})
+	gob.Register(MessageGossipAck{})
+}
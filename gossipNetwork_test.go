@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	gossip "github.com/palSagnik/Distributed-File-Storage/Gossip"
+)
+
+// waitForMember waits until fs sees the member id in state
+func waitForMember(t *testing.T, fs *FileServer, id string, state gossip.State) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m, ok := fs.gossip.Member(id)
+		if ok && m.State == state {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("[%s] wanted %s %s, got %+v", fs.Transport.Addr(), id, state, m)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGossipMembership(t *testing.T) {
+	var servers []*FileServer
+	for _, addrs := range [][2]string{{":3029", ""}, {":3030", ":3029"}, {":3031", ":3030"}} {
+		fs := makeNewServer(addrs[0], addrs[1])
+		fs.GossipInterval = 20 * time.Millisecond
+		defer teardown(t, fs.storage)
+		servers = append(servers, fs)
+	}
+
+	// every node only knows the one started before it
+	for _, fs := range servers {
+		go fs.Start()
+		defer fs.Stop()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	first, last := servers[0], servers[2]
+	waitForMember(t, last, first.ID, gossip.Alive)
+	waitForMember(t, first, last.ID, gossip.Alive)
+
+	if members := last.Members(); len(members) != len(servers) {
+		t.Errorf("wanted %d members, got %+v", len(servers), members)
+	}
+
+	stopServer(last)
+	waitForMember(t, first, last.ID, gossip.Dead)
+	waitForMember(t, servers[1], last.ID, gossip.Dead)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"strconv"
+)
+
+// defining how many points every node gets on the hash ring
+const defaultVirtualNodes = 64
+
+// hashRing places keys on nodes by consistent hashing.
+// Every node owns several points (virtual nodes) on the ring, so keys
+// spread evenly and only a small share of them moves when a node joins or leaves.
+type hashRing struct {
+	virtualNodes int
+
+	// sorted by hash
+	points []ringPoint
+	nodes  map[string]struct{}
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+func newHashRing(virtualNodes int) *hashRing {
+	return &hashRing{
+		virtualNodes: virtualNodes,
+		nodes:        make(map[string]struct{}),
+	}
+}
+
+func ringHash(s string) uint64 {
+	hash := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+func comparePoints(a, b ringPoint) int {
+	switch {
+	case a.hash < b.hash:
+		return -1
+	case a.hash > b.hash:
+		return 1
+	}
+	return 0
+}
+
+func (r *hashRing) Add(node string) {
+	if _, ok := r.nodes[node]; ok {
+		return
+	}
+	r.nodes[node] = struct{}{}
+
+	for i := 0; i < r.virtualNodes; i++ {
+		r.points = append(r.points, ringPoint{
+			hash: ringHash(node + "#" + strconv.Itoa(i)),
+			node: node,
+		})
+	}
+	slices.SortFunc(r.points, comparePoints)
+}
+
+func (r *hashRing) Remove(node string) {
+	if _, ok := r.nodes[node]; !ok {
+		return
+	}
+	delete(r.nodes, node)
+
+	r.points = slices.DeleteFunc(r.points, func(p ringPoint) bool {
+		return p.node == node
+	})
+}
+
+// Owners returns the n distinct nodes responsible for key,
+// the first point at or after the hash of the key and the ones following it
+func (r *hashRing) Owners(key string, n int) []string {
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return nil
+	}
+
+	owners := make([]string, 0, n)
+	start, _ := slices.BinarySearchFunc(r.points, ringPoint{hash: ringHash(key)}, comparePoints)
+	for i := 0; len(owners) < n; i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		if !slices.Contains(owners, node) {
+			owners = append(owners, node)
+		}
+	}
+
+	return owners
+}
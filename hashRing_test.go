@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestHashRingOwners(t *testing.T) {
+	ring := newHashRing(defaultVirtualNodes)
+	for i := 0; i < 5; i++ {
+		ring.Add(fmt.Sprintf("node%d", i))
+	}
+
+	owners := ring.Owners("somekey", 3)
+	if len(owners) != 3 {
+		t.Fatalf("wanted 3 owners, got %v", owners)
+	}
+	for i, owner := range owners {
+		if slices.Contains(owners[i+1:], owner) {
+			t.Errorf("owner %s placed twice in %v", owner, owners)
+		}
+	}
+
+	if got := ring.Owners("somekey", 3); !slices.Equal(got, owners) {
+		t.Errorf("wanted stable placement %v, got %v", owners, got)
+	}
+
+	if got := ring.Owners("somekey", 10); len(got) != 5 {
+		t.Errorf("wanted every one of 5 nodes as owner, got %v", got)
+	}
+}
+
+func TestHashRingRemove(t *testing.T) {
+	ring := newHashRing(defaultVirtualNodes)
+	for i := 0; i < 5; i++ {
+		ring.Add(fmt.Sprintf("node%d", i))
+	}
+
+	keys := make([]string, 1000)
+	before := make(map[string]string)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		before[keys[i]] = ring.Owners(keys[i], 1)[0]
+	}
+
+	ring.Remove("node0")
+
+	// only the keys of the removed node move
+	for _, key := range keys {
+		owner := ring.Owners(key, 1)[0]
+		if owner == "node0" {
+			t.Fatalf("key %s still placed on a removed node", key)
+		}
+		if before[key] != "node0" && before[key] != owner {
+			t.Errorf("key %s moved from %s to %s", key, before[key], owner)
+		}
+	}
+}
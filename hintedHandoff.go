@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	dht "github.com/palSagnik/Distributed-File-Storage/DHT"
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+	p2p "github.com/palSagnik/Distributed-File-Storage/Peer-To-Peer"
+)
+
+// assignHints spreads the owners of key which are disconnected over the peers
+// a Store sends the file to, preferring the peers which stand in for them.
+// It returns the owners every peer keeps a hint for, in the order of peers.
+func (fs *FileServer) assignHints(key string, peers []p2p.Peer) [][]string {
+	fs.lockPeer.Lock()
+	owners := fs.members.Owners(enc.HashKey(key), fs.ReplicationFactor)
+
+	var unreachable []string
+	for _, id := range owners {
+		if _, ok := fs.peers[id]; !ok && id != fs.ID {
+			unreachable = append(unreachable, id)
+		}
+	}
+	fs.lockPeer.Unlock()
+
+	hints := make([][]string, len(peers))
+	if len(unreachable) == 0 {
+		return hints
+	}
+	if len(peers) == 0 {
+		log.Printf("[%s] No peer to keep (%s) for the disconnected owners %v", fs.Transport.Addr(), key, unreachable)
+		return hints
+	}
+
+	// the peers which are not owners themselves only hold the file for the others
+	order := make([]int, 0, len(peers))
+	for i, peer := range peers {
+		if !slices.Contains(owners, peer.ID()) {
+			order = append(order, i)
+		}
+	}
+	for i, peer := range peers {
+		if slices.Contains(owners, peer.ID()) {
+			order = append(order, i)
+		}
+	}
+
+	for i, owner := range unreachable {
+		j := order[i%len(order)]
+		hints[j] = append(hints[j], owner)
+	}
+
+	return hints
+}
+
+// handoff sends a peer which just connected the replicas
+// this node kept hints for while it was disconnected.
+// A replica which was only kept for others is removed once handed off.
+func (fs *FileServer) handoff(peer p2p.Peer) {
+	hints, err := fs.storage.Hints(fs.ID, peer.ID())
+	if err != nil {
+		log.Printf("[%s] Reading hints for %s: %s", fs.Transport.Addr(), peer.ID(), err)
+		return
+	}
+
+	for _, hint := range hints {
+		record, err := fs.storage.Record(fs.ID, hint.Key)
+		if err != nil {
+			log.Printf("[%s] Handing off (%s) to %s: %s", fs.Transport.Addr(), hint.Key, peer.ID(), err)
+			continue
+		}
+
+		// the replica may have been deleted since, or the owner got a newer version
+		if len(record.Key) > 0 {
+			if err := fs.replicate(fs.ctx, peer, record); err != nil && !errors.Is(err, ErrOutdated) {
+				log.Printf("[%s] Handing off (%s) to %s: %s", fs.Transport.Addr(), hint.Key, peer.ID(), err)
+				continue
+			}
+			fmt.Printf("[%s] Handed off (%s) to %s\n", fs.Transport.Addr(), hint.Key, peer.ID())
+		}
+
+		if err := fs.storage.DeleteHint(fs.ID, hint); err != nil {
+			log.Printf("[%s] Deleting hint of (%s) for %s: %s", fs.Transport.Addr(), hint.Key, peer.ID(), err)
+			continue
+		}
+
+		if len(record.Key) > 0 && !fs.owns(fs.ID, hint.Key) && !fs.storage.Hinted(fs.ID, hint.Key) {
+			if err := fs.storage.Delete(fs.ID, hint.Key); err != nil {
+				log.Printf("[%s] Deleting handed off (%s): %s", fs.Transport.Addr(), hint.Key, err)
+			} else {
+				fs.dht.Unprovide(dht.NewID(hint.Key))
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+	p2p "github.com/palSagnik/Distributed-File-Storage/Peer-To-Peer"
+)
+
+// restartServer brings a stopped node back on its address
+// with the same identity, keys and disk
+func restartServer(t *testing.T, old *FileServer, nodes ...string) *FileServer {
+	transport := p2p.NewTCPTransport(p2p.TCPTransportConfig{
+		ListenAddress: old.Transport.Addr(),
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.FrameDecoder{},
+		Encoder:       p2p.FrameEncoder{},
+	})
+
+	fs, err := NewFileServer(FileServerConfig{
+		NodeKey:            old.NodeKey,
+		EncryptionKey:      old.EncryptionKey,
+		StorageRoot:        old.StorageRoot,
+		PathTransformation: old.PathTransformation,
+		Transport:          transport,
+		NodeList:           nodes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.HandshakeFunc = p2p.NodeHandshakeFunc(fs.NodeInfo(), fs.NodeKey)
+	transport.PeerStatus = fs.PeerStatus
+	transport.PeerDisconnect = fs.PeerDisconnect
+
+	return fs
+}
+
+// stopServer takes a node down along with its connections
+func stopServer(fs *FileServer) {
+	fs.Transport.Close()
+	fs.Stop()
+}
+
+func TestHintedHandoff(t *testing.T) {
+	holder := makeNewServer(":3021", "")
+	defer teardown(t, holder.storage)
+	go holder.Start()
+	defer holder.Stop()
+
+	owner := makeNewServer(":3022", "")
+	defer teardown(t, owner.storage)
+	go owner.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	fs := makeNewServer(":3023", ":3021", ":3022")
+	fs.WriteQuorum = 2
+	defer teardown(t, fs.storage)
+	go fs.Start()
+	defer fs.Stop()
+	waitForPeers(t, fs, 2)
+
+	// with a replication factor of 3 every node owns every file
+	stopServer(owner)
+	waitForPeers(t, fs, 1)
+
+	key := "handedoff"
+	if err := fs.Store(key, bytes.NewReader([]byte("keep this for me"))); err != nil {
+		t.Fatal(err)
+	}
+
+	hashedKey := enc.HashKey(key)
+	hints, err := holder.storage.Hints(holder.ID, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hints) != 1 || hints[0].Key != hashedKey {
+		t.Fatalf("wanted a hint of (%s) for %s, got %v", hashedKey, owner.ID, hints)
+	}
+
+	restarted := restartServer(t, owner, ":3021")
+	go restarted.Start()
+	defer restarted.Stop()
+
+	wanted, err := holder.storage.Record(holder.ID, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, err := restarted.storage.Record(restarted.ID, hashedKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == wanted && !holder.storage.Hinted(holder.ID, hashedKey) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted the replica handed off as %+v, got %+v", wanted, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the holder is an owner as well and keeps its replica
+	if !holder.storage.Present(holder.ID, hashedKey) {
+		t.Errorf("wanted the holder to keep (%s)", hashedKey)
+	}
+}
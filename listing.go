@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"slices"
+	"strings"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+	p2p "github.com/palSagnik/Distributed-File-Storage/Peer-To-Peer"
+)
+
+// defining how many files a page of List holds if no limit is given
+const defaultListLimit = 100
+
+// MessageListFiles asks a peer for the records of up to Limit files
+// it holds whose name starts with Prefix and sorts after After
+type MessageListFiles struct {
+	RequestID string
+	Prefix    string
+	After     string
+	Limit     int
+}
+
+// MessageListFilesResponse is the reply to MessageListFiles.
+// More is true if the peer holds more files than it sent.
+type MessageListFilesResponse struct {
+	RequestID string
+	Records   []Record
+	More      bool
+}
+
+// ListPage is a page of the files stored in the cluster, sorted by name.
+// Next is the after of the following page, empty on the last page.
+type ListPage struct {
+	Files []Metadata
+	Next  string
+}
+
+func (fs *FileServer) List(prefix string, after string, limit int) (ListPage, error) {
+	return fs.ListContext(context.Background(), prefix, after, limit)
+}
+
+// ListContext returns up to limit files whose name starts with prefix
+// and sorts after after, held by this node or by any peer answering
+// before the ctx is done or RequestTimeout passed.
+// A file held in several versions is listed with the newest one.
+func (fs *FileServer) ListContext(ctx context.Context, prefix string, after string, limit int) (ListPage, error) {
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+
+	records, more, err := fs.listLocal(prefix, after, limit)
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, fs.RequestTimeout)
+	defer cancel()
+
+	fs.lockPeer.Lock()
+	peers := make([]p2p.Peer, 0, len(fs.peers))
+	for _, peer := range fs.peers {
+		peers = append(peers, peer)
+	}
+	fs.lockPeer.Unlock()
+
+	requestID := enc.GenerateID()
+	responses := fs.openRequest(requestID, peers)
+	defer fs.closeRequest(requestID)
+
+	msg := Message{
+		Payload: MessageListFiles{
+			RequestID: requestID,
+			Prefix:    prefix,
+			After:     after,
+			Limit:     limit,
+		},
+	}
+
+	expected := 0
+	for _, peer := range peers {
+		if err := fs.send(requestCtx, peer, &msg); err != nil {
+			fmt.Printf("[%s] Listing files of %s: %s\n", fs.Transport.Addr(), peer.ID(), err)
+			continue
+		}
+		expected++
+	}
+
+collect:
+	for ; expected > 0; expected-- {
+		select {
+		case res := <-responses:
+			payload, ok := res.Payload.(MessageListFilesResponse)
+			if !ok {
+				fmt.Printf("[%s] Listing files: %s\n", fs.Transport.Addr(), fs.unexpected(res.From, res.Payload))
+				continue
+			}
+			records = append(records, payload.Records...)
+			more = more || payload.More
+		case <-requestCtx.Done():
+			fmt.Printf("[%s] Listing files: %d peers did not answer\n", fs.Transport.Addr(), expected)
+			break collect
+		}
+	}
+
+	// every source sent its first files after after, so the first limit
+	// of all of them are the first limit of the cluster
+	records = newestRecords(records)
+	if len(records) > limit {
+		records, more = records[:limit], true
+	}
+
+	var page ListPage
+	for _, record := range records {
+		page.Files = append(page.Files, record.Metadata)
+	}
+	if more && len(records) > 0 {
+		page.Next = records[len(records)-1].Name
+	}
+
+	return page, nil
+}
+
+// listLocal returns up to limit records of the files this node holds
+// whose name starts with prefix and sorts after after,
+// and whether it holds more of them
+func (fs *FileServer) listLocal(prefix string, after string, limit int) ([]Record, bool, error) {
+	records, err := fs.storage.List(fs.ID, prefix)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// a replica stored before records carried metadata cannot be named
+	records = slices.DeleteFunc(records, func(record Record) bool {
+		return len(record.Name) == 0 || record.Name <= after
+	})
+
+	// the file written by this node and a replica of it count once
+	records = newestRecords(records)
+	if len(records) > limit {
+		return records[:limit], true, nil
+	}
+	return records, false, nil
+}
+
+// newestRecords keeps the newest version of every name, sorted by name
+func newestRecords(records []Record) []Record {
+	newest := make(map[string]Record)
+	for _, record := range records {
+		if r, ok := newest[record.Name]; !ok || record.Version > r.Version {
+			newest[record.Name] = record
+		}
+	}
+
+	kept := make([]Record, 0, len(newest))
+	for _, record := range newest {
+		kept = append(kept, record)
+	}
+	slices.SortFunc(kept, func(a, b Record) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return kept
+}
+
+func (fs *FileServer) handleMessageListFiles(ctx context.Context, from string, msg MessageListFiles) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	limit := msg.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+
+	records, more, err := fs.listLocal(msg.Prefix, msg.After, limit)
+	if err != nil {
+		return err
+	}
+
+	res := MessageListFilesResponse{
+		RequestID: msg.RequestID,
+		Records:   records,
+		More:      more,
+	}
+	return fs.send(ctx, peer, &Message{Payload: res})
+}
+
+func init() {
+	gob.Register(MessageListFiles{})
+	gob.Register(MessageListFilesResponse{})
+}
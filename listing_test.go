@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	var nodes []*FileServer
+	for _, addr := range []string{":3042", ":3043"} {
+		fs := makeNewServer(addr, "")
+		defer teardown(t, fs.storage)
+		go fs.Start()
+		defer fs.Stop()
+		nodes = append(nodes, fs)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	origin := makeNewServer(":3044", ":3042", ":3043")
+	origin.ReplicationFactor = 1
+	defer teardown(t, origin.storage)
+	go origin.Start()
+	defer origin.Stop()
+	waitForPeers(t, origin, 2)
+
+	// the files are spread over the nodes
+	var want []string
+	for i := 0; i < 7; i++ {
+		key := fmt.Sprintf("dir/file-%d", i)
+		if err := origin.Store(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, key)
+	}
+	if err := origin.Store("elsewhere", bytes.NewReader([]byte("not listed"))); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		got   []string
+		pages int
+		after string
+	)
+	for {
+		page, err := origin.List("dir/", after, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Files) > 3 {
+			t.Errorf("wanted at most 3 files in a page, got %d", len(page.Files))
+		}
+		for _, file := range page.Files {
+			got = append(got, file.Name)
+		}
+
+		pages++
+		if len(page.Next) == 0 || pages > 5 {
+			break
+		}
+		after = page.Next
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("wanted %v listed, got %v", want, got)
+	}
+	if pages != 3 {
+		t.Errorf("wanted 3 pages, got %d", pages)
+	}
+}
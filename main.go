@@ -18,7 +18,8 @@ func makeNewServer(listenAddress string, nodes ...string) *FileServer {
 	tcpConfig := p2p.TCPTransportConfig{
 		ListenAddress: listenAddress,
 		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
+		Decoder:       p2p.FrameDecoder{},
+		Encoder:       p2p.FrameEncoder{},
 	}
 
 	transport := p2p.NewTCPTransport(tcpConfig)
@@ -31,8 +32,13 @@ func makeNewServer(listenAddress string, nodes ...string) *FileServer {
 		NodeList:           nodes,
 	}
 
-	fs := NewFileServer(fsConfig)
+	fs, err := NewFileServer(fsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	transport.HandshakeFunc = p2p.NodeHandshakeFunc(fs.NodeInfo(), fs.NodeKey)
 	transport.PeerStatus = fs.PeerStatus
+	transport.PeerDisconnect = fs.PeerDisconnect
 
 	return fs
 }
@@ -40,8 +46,10 @@ func makeNewServer(listenAddress string, nodes ...string) *FileServer {
 func main() {
 
 	fs1 := makeNewServer(":9000", "")
-	fs2 := makeNewServer(":9001", "")
-	fs3 := makeNewServer(":9002", ":9001", ":9000")
+	fs2 := makeNewServer(":9001", ":9000")
+
+	// fs3 learns about fs1 from fs2
+	fs3 := makeNewServer(":9002", ":9001")
 
 	go func() { log.Fatal(fs1.Start()) }()	
 	time.Sleep(2 * time.Second)
@@ -56,6 +64,9 @@ func main() {
 		data := bytes.NewReader([]byte("hello this is me"))
 		fs3.Store(key, data)
 
+		// the peers write their replicas in the background
+		time.Sleep(50 * time.Millisecond)
+
 		if err := fs3.storage.Delete(fs3.ID, key); err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps the files in memory, for tests
+// and nodes which do not need to outlive their process
+type MemoryBackend struct {
+	lock  sync.RWMutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		files: make(map[string]memoryFile),
+	}
+}
+
+// Put keeps nothing if reading r fails
+func (b *MemoryBackend) Put(name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.files[name] = memoryFile{data: data, modTime: time.Now()}
+	return int64(len(data)), nil
+}
+
+func (b *MemoryBackend) Get(name string) (int64, io.ReadCloser, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	f, ok := b.files[name]
+	if !ok {
+		return 0, nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	// a file is replaced and never changed, so its data can be read unlocked
+	return int64(len(f.data)), io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func (b *MemoryBackend) Has(name string) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	_, ok := b.files[name]
+	return ok
+}
+
+func (b *MemoryBackend) Delete(name string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for n := range b.files {
+		if name == "" || n == name || strings.HasPrefix(n, name+"/") {
+			delete(b.files, n)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Stat(name string) (Entry, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	f, ok := b.files[name]
+	if !ok {
+		return Entry{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return Entry{Name: name, Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+func (b *MemoryBackend) List(prefix string) ([]string, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	var names []string
+	for name := range b.files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	return names, nil
+}
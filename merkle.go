@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"strings"
+)
+
+const (
+	// defining the number of buckets the keys are spread over,
+	// each one a leaf of the Merkle tree
+	merkleLeaves = 256
+
+	merkleNodes = 2*merkleLeaves - 1
+)
+
+// merkleTree summarises a set of records so two nodes can find the records
+// they disagree on without exchanging all of them. The nodes are stored
+// level by level: the root first, the children of node i at 2i+1 and 2i+2
+// and the leaves, one per bucket of keys, last.
+type merkleTree [merkleNodes][sha256.Size]byte
+
+// merkleBucket returns the leaf a key is summarised in
+func merkleBucket(key string) int {
+	hash := sha256.Sum256([]byte(key))
+	return int(hash[0]) % merkleLeaves
+}
+
+// newMerkleTree summarises records by the key of their replicas
+func newMerkleTree(records []Record) *merkleTree {
+	buckets := make([][]Record, merkleLeaves)
+	for _, record := range records {
+		i := merkleBucket(record.replicaKey())
+		buckets[i] = append(buckets[i], record)
+	}
+
+	tree := new(merkleTree)
+	for i, bucket := range buckets {
+		slices.SortFunc(bucket, func(a, b Record) int {
+			return strings.Compare(a.replicaKey(), b.replicaKey())
+		})
+
+		// a file written by a node has no checksum of its replica,
+		// the versions tell the copies apart
+		hash := sha256.New()
+		for _, record := range bucket {
+			hash.Write([]byte(record.replicaKey()))
+			hash.Write(binary.BigEndian.AppendUint64(nil, uint64(record.Version)))
+		}
+		hash.Sum(tree[merkleLeaves-1+i][:0])
+	}
+
+	for i := merkleLeaves - 2; i >= 0; i-- {
+		hash := sha256.New()
+		hash.Write(tree[2*i+1][:])
+		hash.Write(tree[2*i+2][:])
+		hash.Sum(tree[i][:0])
+	}
+
+	return tree
+}
+
+// diff returns the buckets whose leaves differ between the trees,
+// descending only into the subtrees whose roots differ
+func (t *merkleTree) diff(other *merkleTree) []int {
+	var buckets []int
+
+	pending := []int{0}
+	for len(pending) > 0 {
+		i := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if t[i] == other[i] {
+			continue
+		}
+		if i >= merkleLeaves-1 {
+			buckets = append(buckets, i-(merkleLeaves-1))
+			continue
+		}
+		pending = append(pending, 2*i+2, 2*i+1)
+	}
+
+	return buckets
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+)
+
+func TestMerkleTreeDiff(t *testing.T) {
+	var records []Record
+	for i := 0; i < 1000; i++ {
+		records = append(records, Record{Key: fmt.Sprintf("key%d", i), Version: 1, Checksum: "abc"})
+	}
+
+	tree := newMerkleTree(records)
+	if buckets := tree.diff(newMerkleTree(slices.Clone(records))); len(buckets) != 0 {
+		t.Errorf("wanted identical trees, got differing buckets %v", buckets)
+	}
+
+	// a missing record and a newer version
+	other := slices.Clone(records)
+	other = slices.Delete(other, 10, 11)
+	other[500].Version = 2
+
+	buckets := tree.diff(newMerkleTree(other))
+	wanted := []int{merkleBucket(records[10].Key), merkleBucket(records[501].Key)}
+	slices.Sort(wanted)
+	wanted = slices.Compact(wanted)
+	slices.Sort(buckets)
+	if !slices.Equal(buckets, wanted) {
+		t.Errorf("wanted differing buckets %v, got %v", wanted, buckets)
+	}
+}
+
+func TestMerkleTreeOwnCopy(t *testing.T) {
+	// the file written by a node and a replica of the same version agree
+	own := []Record{{Key: "written", Version: 1}}
+	replica := []Record{{Key: enc.HashKey("written"), Version: 1, Checksum: "abc"}}
+	if buckets := newMerkleTree(own).diff(newMerkleTree(replica)); len(buckets) != 0 {
+		t.Errorf("wanted identical trees, got differing buckets %v", buckets)
+	}
+}
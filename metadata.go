@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+)
+
+// MessageStatFile asks a peer for the record of its replica of a file
+type MessageStatFile struct {
+	RequestID string
+	Key       string
+}
+
+// MessageStatFileResponse is the reply to MessageStatFile,
+// Record is set if Found is true
+type MessageStatFileResponse struct {
+	RequestID string
+	Found     bool
+	Record    Record
+}
+
+// contentType guesses the content type of a file from the extension of its key,
+// or else from the first bytes of it, which stay buffered in r
+func contentType(key string, r *bufio.Reader) string {
+	if t := mime.TypeByExtension(path.Ext(key)); len(t) > 0 {
+		return t
+	}
+
+	head, _ := r.Peek(512)
+	return http.DetectContentType(head)
+}
+
+// created returns when the first version of a file known to this node
+// was stored, now if it is the first one
+func (fs *FileServer) created(key string, now time.Time) time.Time {
+	for _, k := range []string{key, enc.HashKey(key)} {
+		record, err := fs.storage.Record(fs.ID, k)
+		if err == nil && !record.Created.IsZero() {
+			return record.Created
+		}
+	}
+	return now
+}
+
+// Stat returns the metadata of the newest version of a file
+// held by this node or by the owners of its key
+func (fs *FileServer) Stat(key string) (Metadata, error) {
+	return fs.StatContext(context.Background(), key)
+}
+
+// StatContext is Stat which stops asking the owners once the ctx is done
+func (fs *FileServer) StatContext(ctx context.Context, key string) (Metadata, error) {
+	var (
+		newest Record
+		found  bool
+	)
+	keep := func(record Record) {
+		if !found || record.Version > newest.Version {
+			newest, found = record, true
+		}
+	}
+
+	// the file written by this node, then a replica of it
+	for _, k := range []string{key, enc.HashKey(key)} {
+		record, err := fs.storage.Stat(fs.ID, k)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return Metadata{}, err
+		}
+		keep(record)
+	}
+
+	peers, _ := fs.owners(key)
+	for _, peer := range peers {
+		res, err := fs.request(ctx, peer, func(requestID string) any {
+			return MessageStatFile{RequestID: requestID, Key: enc.HashKey(key)}
+		})
+		if err != nil {
+			log.Printf("[%s] Asking %s for (%s): %s", fs.Transport.Addr(), peer.ID(), key, err)
+			continue
+		}
+		payload, ok := res.(MessageStatFileResponse)
+		if !ok {
+			log.Printf("[%s] Asking %s for (%s): %s", fs.Transport.Addr(), peer.ID(), key, fs.unexpected(peer.ID(), res))
+			continue
+		}
+		if payload.Found {
+			keep(payload.Record)
+		}
+	}
+
+	if !found {
+		return Metadata{}, fmt.Errorf("[%s] (%s): %w", fs.Transport.Addr(), key, ErrFileNotFound)
+	}
+
+	// a replica stored before records carried metadata does not know its name
+	if len(newest.Name) == 0 {
+		newest.Name = key
+	}
+	return newest.Metadata, nil
+}
+
+func (fs *FileServer) handleMessageStatFile(ctx context.Context, from string, msg MessageStatFile) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	res := MessageStatFileResponse{RequestID: msg.RequestID}
+
+	record, err := fs.storage.Stat(fs.ID, msg.Key)
+	switch {
+	case err == nil:
+		res.Found, res.Record = true, record
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	return fs.send(ctx, peer, &Message{Payload: res})
+}
+
+func init() {
+	gob.Register(MessageStatFile{})
+	gob.Register(MessageStatFileResponse{})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+)
+
+func TestContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n an image")
+
+	for _, tc := range []struct {
+		key  string
+		data []byte
+		want string
+	}{
+		{"notes.txt", png, "text/plain; charset=utf-8"},
+		{"picture", png, "image/png"},
+		{"unknown", []byte{0, 1, 2}, "application/octet-stream"},
+	} {
+		r := bufio.NewReader(bytes.NewReader(tc.data))
+		if got := contentType(tc.key, r); got != tc.want {
+			t.Errorf("wanted %s for (%s), got %s", tc.want, tc.key, got)
+		}
+
+		// the sniffed bytes are still read
+		if b, _ := io.ReadAll(r); !bytes.Equal(b, tc.data) {
+			t.Errorf("wanted %q read after sniffing, got %q", tc.data, b)
+		}
+	}
+}
+
+func TestStat(t *testing.T) {
+	holder := makeNewServer(":3040", "")
+	defer teardown(t, holder.storage)
+	go holder.Start()
+	defer holder.Stop()
+
+	origin := makeNewServer(":3041", ":3040")
+	origin.ReplicationFactor = 2
+	origin.WriteQuorum = 2
+	defer teardown(t, origin.storage)
+	go origin.Start()
+	defer origin.Stop()
+	waitForPeers(t, origin, 1)
+
+	key := "notes.txt"
+	data := []byte("metadata travels with the replicas")
+	if err := origin.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := origin.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Name != key || first.Size != int64(len(data)) || first.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("wanted %s of %d bytes, got %+v", key, len(data), first)
+	}
+	if first.Created.IsZero() || !first.Created.Equal(first.Modified) {
+		t.Errorf("wanted the first version created when it was modified, got %+v", first)
+	}
+
+	// the replica was acknowledged once its record was written
+	replica, err := holder.storage.Stat(holder.ID, enc.HashKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replica.Name != key || replica.Size != first.Size || replica.ContentType != first.ContentType || !replica.Created.Equal(first.Created) {
+		t.Errorf("wanted the metadata %+v on the replica, got %+v", first, replica.Metadata)
+	}
+
+	// the SHA-256 of the file follows the replica once all of it was sent
+	if sum := sha256.Sum256(data); first.SHA256 != hex.EncodeToString(sum[:]) || replica.SHA256 != first.SHA256 {
+		t.Errorf("wanted the SHA-256 %x on the file and its replica, got %s and %s", sum, first.SHA256, replica.SHA256)
+	}
+
+	// a new version keeps the creation of the first one
+	if err := origin.Store(key, bytes.NewReader([]byte("shorter"))); err != nil {
+		t.Fatal(err)
+	}
+	second, err := origin.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Created.Equal(first.Created) || !second.Modified.After(first.Modified) || second.Size != 7 {
+		t.Errorf("wanted a newer version of 7 bytes created with the first one %+v, got %+v", first, second)
+	}
+
+	// without a local copy the owners are asked
+	origin.storage.Delete(origin.ID, key)
+	if got, err := origin.Stat(key); err != nil || got.Name != key || !got.Modified.Equal(second.Modified) {
+		t.Errorf("wanted %+v from the holder, got %+v (%v)", second, got, err)
+	}
+
+	if _, err := origin.Stat("nosuchfile"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("wanted %s, got %v", ErrFileNotFound, err)
+	}
+}
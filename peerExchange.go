@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"log"
+
+	dht "github.com/palSagnik/Distributed-File-Storage/DHT"
+	p2p "github.com/palSagnik/Distributed-File-Storage/Peer-To-Peer"
+)
+
+// defining how many peers a node connects to on its own through peer exchange
+const defaultPeerTarget = 8
+
+// MessagePeerExchange shares the peers of the sender,
+// which answers with MessagePeerExchangeResponse sharing its own
+type MessagePeerExchange struct {
+	RequestID string
+	Peers     []dht.Contact
+}
+
+type MessagePeerExchangeResponse struct {
+	RequestID string
+	Peers     []dht.Contact
+}
+
+// knownPeers returns how the connected peers are reached
+func (fs *FileServer) knownPeers() []dht.Contact {
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
+
+	contacts := make([]dht.Contact, 0, len(fs.peers))
+	for _, peer := range fs.peers {
+		contacts = append(contacts, contact(peer))
+	}
+	return contacts
+}
+
+// exchangePeers trades the known peers with a peer
+// and connects to the ones this node is not connected to yet
+func (fs *FileServer) exchangePeers(ctx context.Context, peer p2p.Peer) {
+	if !fs.belowPeerTarget() {
+		return
+	}
+
+	res, err := fs.request(ctx, peer, func(requestID string) any {
+		return MessagePeerExchange{RequestID: requestID, Peers: fs.knownPeers()}
+	})
+	if err != nil {
+		log.Printf("[%s] Exchanging peers with %s: %s", fs.Transport.Addr(), peer.ID(), err)
+		return
+	}
+
+	payload, ok := res.(MessagePeerExchangeResponse)
+	if !ok {
+		log.Printf("[%s] Exchanging peers with %s: %s", fs.Transport.Addr(), peer.ID(), fs.unexpected(peer.ID(), res))
+		return
+	}
+
+	fs.discover(ctx, payload.Peers)
+}
+
+// discover connects to the nodes among contacts which are not peers yet,
+// until this node has PeerTarget peers. Every new peer shares its own in turn.
+func (fs *FileServer) discover(ctx context.Context, contacts []dht.Contact) {
+	for _, c := range contacts {
+		if !fs.belowPeerTarget() {
+			return
+		}
+		if _, ok := fs.peer(c.ID); ok || c.ID == fs.ID || len(c.Addr) == 0 {
+			continue
+		}
+
+		if _, err := fs.connect(ctx, c); err != nil {
+			log.Printf("[%s] Connecting to shared peer %s at %s: %s", fs.Transport.Addr(), c.ID, c.Addr, err)
+		}
+	}
+}
+
+func (fs *FileServer) belowPeerTarget() bool {
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
+
+	return len(fs.ownPeers()) < fs.PeerTarget
+}
+
+// ownPeers returns the peers but those dialed for calls only, caller holds lockPeer
+func (fs *FileServer) ownPeers() []p2p.Peer {
+	peers := make([]p2p.Peer, 0, len(fs.peers))
+	for _, peer := range fs.peers {
+		if _, ok := fs.calls[peer]; !ok {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// replacePeer asks a remaining peer for others once one was lost, caller holds lockPeer
+func (fs *FileServer) replacePeer() {
+	peers := fs.ownPeers()
+	if len(peers) == 0 || len(peers) >= fs.PeerTarget {
+		return
+	}
+
+	go fs.exchangePeers(fs.ctx, peers[0])
+}
+
+func (fs *FileServer) handleMessagePeerExchange(ctx context.Context, from string, msg MessagePeerExchange) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+
+	res := MessagePeerExchangeResponse{
+		RequestID: msg.RequestID,
+		Peers:     fs.knownPeers(),
+	}
+	if err := fs.send(ctx, peer, &Message{Payload: res}); err != nil {
+		return err
+	}
+
+	fs.discover(ctx, msg.Peers)
+	return nil
+}
+
+func init() {
+	gob.Register(MessagePeerExchange{})
+	gob.Register(MessagePeerExchangeResponse{})
+}
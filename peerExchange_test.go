@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	dht "github.com/palSagnik/Distributed-File-Storage/DHT"
+	gossip "github.com/palSagnik/Distributed-File-Storage/Gossip"
+)
+
+// startSeeded starts nodes which only know the seed,
+// with gossip slowed down so its probes do not make them find each other
+func startSeeded(t *testing.T, seed string, target int, addrs ...string) []*FileServer {
+	t.Helper()
+
+	var servers []*FileServer
+	for _, addr := range addrs {
+		fs := makeNewServer(addr, seed)
+		fs.GossipInterval = time.Hour
+		if target > 0 {
+			fs.PeerTarget = target
+		}
+		t.Cleanup(func() {
+			fs.Stop()
+			teardown(t, fs.storage)
+		})
+		go fs.Start()
+		servers = append(servers, fs)
+	}
+	return servers
+}
+
+func TestPeerExchange(t *testing.T) {
+	seed := startSeeded(t, "", 0, ":3032")[0]
+	time.Sleep(100 * time.Millisecond)
+
+	servers := startSeeded(t, ":3032", 0, ":3033", ":3034", ":3035")
+	for _, fs := range servers {
+		waitForPeers(t, fs, len(servers))
+	}
+	waitForPeers(t, seed, len(servers))
+}
+
+func TestPeerExchangeTarget(t *testing.T) {
+	seed := startSeeded(t, "", 0, ":3036")[0]
+	time.Sleep(100 * time.Millisecond)
+
+	fs := startSeeded(t, ":3036", 1, ":3037")[0]
+	waitForPeers(t, fs, 1)
+
+	// a node outside of the network is shared
+	outside := startSeeded(t, "", 0, ":3038")[0]
+	time.Sleep(100 * time.Millisecond)
+	shared := []dht.Contact{{ID: seed.ID, Addr: ":3036"}, {ID: outside.ID, Addr: ":3038"}}
+
+	fs.discover(context.Background(), shared)
+	waitForPeers(t, fs, 1)
+
+	fs.PeerTarget = 2
+	fs.discover(context.Background(), shared)
+	waitForPeers(t, fs, 2)
+	if _, ok := fs.peer(outside.ID); !ok {
+		t.Errorf("wanted to be connected to %s", outside.ID)
+	}
+}
+
+func TestPeerTargetHolds(t *testing.T) {
+	var servers []*FileServer
+	for _, addrs := range [][2]string{{":3068", ""}, {":3069", ":3068"}, {":3070", ":3068"}, {":3071", ":3068"}, {":3072", ":3068"}} {
+		fs := makeNewServer(addrs[0], addrs[1])
+		fs.GossipInterval = 20 * time.Millisecond
+		fs.PeerTarget = 1
+		defer teardown(t, fs.storage)
+		go fs.Start()
+		defer fs.Stop()
+		servers = append(servers, fs)
+		time.Sleep(50 * time.Millisecond)
+	}
+	seed, nodes := servers[0], servers[1:]
+
+	// the last node looks up the others in the DHT and probes them
+	last := nodes[len(nodes)-1]
+	for _, other := range nodes[:len(nodes)-1] {
+		waitForMember(t, last, other.ID, gossip.Alive)
+	}
+	if err := seed.Store("announced", bytes.NewReader([]byte("found through the DHT"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// but only keep the seed as their peer
+	for _, fs := range nodes {
+		waitForPeers(t, fs, 1)
+		if _, ok := fs.peer(seed.ID); !ok {
+			t.Errorf("[%s] wanted to stay connected to the seed", fs.Transport.Addr())
+		}
+	}
+	waitForPeers(t, seed, len(nodes))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	dht "github.com/palSagnik/Distributed-File-Storage/DHT"
+	p2p "github.com/palSagnik/Distributed-File-Storage/Peer-To-Peer"
+)
+
+// MessageRepairFile asks the holder of a replica to send it to Targets,
+// which answered a Get without the replica or with another version of it
+type MessageRepairFile struct {
+	Key      string
+	Version  int64
+	Checksum string
+	Targets  []dht.Contact
+}
+
+// readRepair asks the peer which offered the newest copy of a file during a Get
+// to send it to the peers which answered without it or with another version.
+// The repair happens in the background, Get does not wait for it.
+func (fs *FileServer) readRepair(newest *replica, replicas []replica, missing []p2p.Peer) {
+	if newest == nil {
+		return
+	}
+
+	var targets []dht.Contact
+	for _, peer := range missing {
+		targets = append(targets, contact(peer))
+	}
+	for _, r := range replicas {
+		if r.Version != newest.Version || r.Checksum != newest.Checksum {
+			targets = append(targets, contact(r.peer))
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	msg := Message{
+		Payload: MessageRepairFile{
+			Key:      newest.Key,
+			Version:  newest.Version,
+			Checksum: newest.Checksum,
+			Targets:  targets,
+		},
+	}
+
+	go func() {
+		if err := fs.send(fs.ctx, newest.peer, &msg); err != nil {
+			log.Printf("[%s] Requesting repair of (%s): %s", fs.Transport.Addr(), newest.Key, err)
+		}
+	}()
+}
+
+// localRepair sends the copy of a file this node wrote itself, which was the newest
+// during a Get, to the peers which answered without it or with an older version.
+// The repair happens in the background, Get does not wait for it.
+func (fs *FileServer) localRepair(record Record, replicas []replica, missing []p2p.Peer) {
+	targets := slices.Clone(missing)
+	for _, r := range replicas {
+		if r.Version < record.Version {
+			targets = append(targets, r.peer)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	go func() {
+		for _, peer := range targets {
+			err := fs.replicate(fs.ctx, peer, record)
+			if errors.Is(err, ErrOutdated) {
+				continue
+			}
+			if err != nil {
+				log.Printf("[%s] Repairing (%s) on %s: %s", fs.Transport.Addr(), record.Key, peer.ID(), err)
+				continue
+			}
+			fmt.Printf("[%s] Repaired (%s) on %s\n", fs.Transport.Addr(), record.Key, peer.ID())
+		}
+	}()
+}
+
+func (fs *FileServer) handleMessageRepairFile(ctx context.Context, from string, msg MessageRepairFile) error {
+	record, err := fs.storage.Record(fs.ID, msg.Key)
+	if err != nil {
+		return err
+	}
+
+	// the replica changed since it was offered
+	if record.Version != msg.Version || record.Checksum != msg.Checksum {
+		return fmt.Errorf("[%s] asked by %s to repair (%s) version %d, holding version %d", fs.Transport.Addr(), from, msg.Key, msg.Version, record.Version)
+	}
+
+	for _, target := range msg.Targets {
+		peer, err := fs.connect(ctx, target)
+		if err == nil {
+			err = fs.replicate(ctx, peer, record)
+		}
+		if errors.Is(err, ErrOutdated) {
+			continue
+		}
+		if err != nil {
+			log.Printf("[%s] Repairing (%s) on %s: %s", fs.Transport.Addr(), msg.Key, target.ID, err)
+			continue
+		}
+		fmt.Printf("[%s] Repaired (%s) on %s\n", fs.Transport.Addr(), msg.Key, target.ID)
+	}
+
+	return nil
+}
+
+func init() {
+	gob.Register(MessageRepairFile{})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+)
+
+func TestReadRepair(t *testing.T) {
+	var replicas []*FileServer
+	for _, addr := range []string{":3018", ":3019"} {
+		fs := makeNewServer(addr, "")
+		defer teardown(t, fs.storage)
+		go fs.Start()
+		defer fs.Stop()
+		replicas = append(replicas, fs)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	fs := makeNewServer(":3020", ":3018", ":3019")
+	fs.WriteQuorum, fs.ReadQuorum = 3, 2
+	defer teardown(t, fs.storage)
+	go fs.Start()
+	defer fs.Stop()
+	waitForPeers(t, fs, 2)
+
+	key := "repairedonread"
+	if err := fs.Store(key, bytes.NewReader([]byte("read me"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replicas find each other through the DHT,
+	// the repair goes over the connection they settle on
+	for _, r := range replicas {
+		waitForPeers(t, r, 2)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// one replica got lost and the local copy is gone
+	healthy, lost := replicas[0], replicas[1]
+	hashedKey := enc.HashKey(key)
+	if err := lost.storage.Delete(lost.ID, hashedKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.storage.Delete(fs.ID, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Get(key); err != nil {
+		t.Fatal(err)
+	}
+
+	wanted, err := healthy.storage.Record(healthy.ID, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		got, err := lost.storage.Record(lost.ID, hashedKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == wanted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted the replica repaired to %+v, got %+v", wanted, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadRepairFromLocal(t *testing.T) {
+	var replicas []*FileServer
+	for _, addr := range []string{":3055", ":3056"} {
+		fs := makeNewServer(addr, "")
+		defer teardown(t, fs.storage)
+		go fs.Start()
+		defer fs.Stop()
+		replicas = append(replicas, fs)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	fs := makeNewServer(":3057", ":3055", ":3056")
+	fs.WriteQuorum, fs.ReadQuorum = 3, 2
+	defer teardown(t, fs.storage)
+	go fs.Start()
+	defer fs.Stop()
+	waitForPeers(t, fs, 2)
+
+	key := "repairedfromlocal"
+	data := []byte("the local copy is the newest")
+	if err := fs.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replicas got lost, the local copy is the only one left
+	hashedKey := enc.HashKey(key)
+	for _, r := range replicas {
+		if err := r.storage.Delete(r.ID, hashedKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := fs.Get(key); err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := fs.storage.Record(fs.ID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range replicas {
+		deadline := time.Now().Add(time.Second)
+		for {
+			got, err := r.storage.Record(r.ID, hashedKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Version == local.Version {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("wanted the replica repaired to version %d, got %+v", local.Version, got)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		_, rr, err := r.storage.Read(r.ID, hashedKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain := new(bytes.Buffer)
+		if _, err := enc.StreamDecrypt(fs.EncryptionKey, rr, plain); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain.Bytes(), data) {
+			t.Errorf("wanted %s, got %s", data, plain)
+		}
+	}
+}
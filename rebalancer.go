@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	dht "github.com/palSagnik/Distributed-File-Storage/DHT"
+	p2p "github.com/palSagnik/Distributed-File-Storage/Peer-To-Peer"
+)
+
+// defining how long the membership must stay unchanged before data moves
+const defaultRebalanceDelay = time.Second
+
+// RebalanceProgress reports the rebalancing started by the last membership change
+type RebalanceProgress struct {
+	Running bool
+
+	// Files and Bytes are the replicas the round sends to their new owners,
+	// FilesDone and BytesDone what reached them so far, Failures what did not
+	Files     int
+	FilesDone int
+	Failures  int
+	Bytes     int64
+	BytesDone int64
+
+	// Dropped is the number of replicas removed because
+	// this node no longer owns them and every owner holds them
+	Dropped int
+}
+
+type rebalanceState struct {
+	// round is held by the round in progress, one runs at a time
+	round sync.Mutex
+
+	lock     sync.Mutex
+	progress RebalanceProgress
+}
+
+func (fs *FileServer) RebalanceProgress() RebalanceProgress {
+	fs.rebalanceState.lock.Lock()
+	defer fs.rebalanceState.lock.Unlock()
+
+	return fs.rebalanceState.progress
+}
+
+func (fs *FileServer) updateRebalance(update func(*RebalanceProgress)) {
+	fs.rebalanceState.lock.Lock()
+	defer fs.rebalanceState.lock.Unlock()
+
+	update(&fs.rebalanceState.progress)
+}
+
+// scheduleRebalance is called on every membership change, caller holds lockPeer
+func (fs *FileServer) scheduleRebalance() {
+	select {
+	case fs.rebalanceChannel <- struct{}{}:
+	default:
+	}
+}
+
+// rebalancer moves the replicas to their owners once the
+// membership stopped changing for RebalanceDelay, until Stop
+func (fs *FileServer) rebalancer() {
+	for {
+		select {
+		case <-fs.rebalanceChannel:
+		case <-fs.quitChannel:
+			return
+		}
+
+		// nodes often join or leave in groups, which is one round
+		delay := time.NewTimer(fs.RebalanceDelay)
+	settle:
+		for {
+			select {
+			case <-fs.rebalanceChannel:
+				delay.Reset(fs.RebalanceDelay)
+			case <-delay.C:
+				break settle
+			case <-fs.quitChannel:
+				delay.Stop()
+				return
+			}
+		}
+
+		fs.rebalanceRound(fs.ctx)
+	}
+}
+
+// transfer is a replica on its way to a new owner
+type transfer struct {
+	peer   p2p.Peer
+	record Record
+	size   int64
+}
+
+// rebalanceRound sends every peer the replicas it owns but is missing,
+// then drops the replicas this node no longer owns once all their owners hold them.
+// It returns the number of replicas this node does not own which it still holds.
+func (fs *FileServer) rebalanceRound(ctx context.Context) int {
+	fs.rebalanceState.round.Lock()
+	defer fs.rebalanceState.round.Unlock()
+
+	records, err := fs.storage.Records(fs.ID)
+	if err != nil {
+		log.Printf("[%s] Rebalancing: %s", fs.Transport.Addr(), err)
+		return -1
+	}
+
+	fs.lockPeer.Lock()
+	peers := make([]p2p.Peer, 0, len(fs.peers))
+	for _, peer := range fs.peers {
+		peers = append(peers, peer)
+	}
+	fs.lockPeer.Unlock()
+
+	// held holds the owners known to hold the current version of a replica
+	var (
+		transfers []transfer
+		held      = make(map[string]map[string]bool)
+		total     int64
+	)
+	hold := func(key string, id string) {
+		if held[key] == nil {
+			held[key] = make(map[string]bool)
+		}
+		held[key][id] = true
+	}
+
+	for _, peer := range peers {
+		shared, err := fs.sharedReplicas(peer.ID())
+		if err != nil {
+			log.Printf("[%s] Rebalancing with %s: %s", fs.Transport.Addr(), peer.ID(), err)
+			continue
+		}
+
+		outdated, err := fs.outdated(ctx, peer, shared)
+		if err != nil {
+			log.Printf("[%s] Rebalancing with %s: %s", fs.Transport.Addr(), peer.ID(), err)
+			continue
+		}
+
+		missing := make(map[string]bool, len(outdated))
+		for _, record := range outdated {
+			missing[record.replicaKey()] = true
+
+			// a tombstone is sent without a file
+			var size int64
+			if !record.Deleted {
+				size, err = fs.replicaSize(record.Key)
+			}
+			if err != nil {
+				log.Printf("[%s] Rebalancing (%s): %s", fs.Transport.Addr(), record.Key, err)
+				continue
+			}
+			transfers = append(transfers, transfer{peer: peer, record: record, size: size})
+			total += size
+		}
+
+		for _, record := range shared {
+			if !missing[record.replicaKey()] {
+				hold(record.replicaKey(), peer.ID())
+			}
+		}
+	}
+
+	fs.updateRebalance(func(p *RebalanceProgress) {
+		*p = RebalanceProgress{Running: true, Files: len(transfers), Bytes: total}
+	})
+	if len(transfers) > 0 {
+		fmt.Printf("[%s] Rebalancing %d replicas (%d bytes)\n", fs.Transport.Addr(), len(transfers), total)
+	}
+
+	// one limit is shared by all transfers of the round
+	limit := newRateLimiter(fs.RebalanceBandwidth)
+	for i, t := range transfers {
+		err := fs.replicateThrough(ctx, t.peer, t.record, func(r io.Reader) io.Reader {
+			return &limitedReader{ctx: ctx, r: r, limit: limit, read: func(n int) {
+				fs.updateRebalance(func(p *RebalanceProgress) { p.BytesDone += int64(n) })
+			}}
+		})
+
+		// an owner holding a newer version holds the replica as well
+		if err != nil && !errors.Is(err, ErrOutdated) {
+			fs.updateRebalance(func(p *RebalanceProgress) { p.Failures++ })
+			log.Printf("[%s] Moving (%s) to %s: %s", fs.Transport.Addr(), t.record.Key, t.peer.ID(), err)
+			continue
+		}
+
+		hold(t.record.replicaKey(), t.peer.ID())
+		fs.updateRebalance(func(p *RebalanceProgress) { p.FilesDone++ })
+		fmt.Printf("[%s] Moved (%s) to %s, %d of %d\n", fs.Transport.Addr(), t.record.Key, t.peer.ID(), i+1, len(transfers))
+	}
+
+	remaining := 0
+	for _, record := range records {
+		if len(record.Checksum) == 0 && !record.Deleted {
+			continue
+		}
+
+		owners := fs.replicaOwners(record.Key)
+		if slices.Contains(owners, fs.ID) {
+			continue
+		}
+
+		// with no peer to own it, the replica is the only one left
+		everyOwner := len(owners) > 0
+		for _, owner := range owners {
+			everyOwner = everyOwner && held[record.Key][owner]
+		}
+		if !everyOwner || fs.storage.Hinted(fs.ID, record.Key) {
+			remaining++
+			continue
+		}
+
+		if err := fs.storage.Delete(fs.ID, record.Key); err != nil {
+			remaining++
+			log.Printf("[%s] Dropping (%s): %s", fs.Transport.Addr(), record.Key, err)
+			continue
+		}
+		fs.dht.Unprovide(dht.NewID(record.Key))
+		fs.updateRebalance(func(p *RebalanceProgress) { p.Dropped++ })
+	}
+
+	fs.updateRebalance(func(p *RebalanceProgress) { p.Running = false })
+	return remaining
+}
+
+// replicaOwners returns the nodes owning a replica stored under hashedKey
+func (fs *FileServer) replicaOwners(hashedKey string) []string {
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
+
+	return fs.ring.Owners(hashedKey, fs.ReplicationFactor)
+}
+
+func (fs *FileServer) replicaSize(key string) (int64, error) {
+	size, r, err := fs.storage.Read(fs.ID, key)
+	if err != nil {
+		return 0, err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		rc.Close()
+	}
+	return size, nil
+}
+
+// rateLimiter spreads what is sent so it stays under rate bytes per second
+// on average, if rate is not positive nothing is held back
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+// wait accounts for n more bytes and blocks until they fit the rate
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l.rate <= 0 {
+		return nil
+	}
+
+	l.sent += int64(n)
+	due := l.start.Add(time.Duration(float64(l.sent) / float64(l.rate) * float64(time.Second)))
+
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader reports and rate limits what is read from r
+type limitedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	limit *rateLimiter
+	read  func(n int)
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.read(n)
+		if waitErr := r.limit.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limit := newRateLimiter(1000 * 1000)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := limit.wait(context.Background(), 50*1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 200kB at 1MB/s
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("wanted the transfer spread over 200ms, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limit.wait(ctx, 1000*1000); err != context.Canceled {
+		t.Errorf("wanted %v, got %v", context.Canceled, err)
+	}
+
+	if err := newRateLimiter(0).wait(context.Background(), 1000*1000); err != nil {
+		t.Errorf("wanted no limit, got %v", err)
+	}
+}
+
+func TestRebalanceJoin(t *testing.T) {
+	fs := makeNewServer(":3024", "")
+	fs.ReplicationFactor = 1
+	fs.RebalanceDelay = 10 * time.Millisecond
+	defer teardown(t, fs.storage)
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := enc.HashKey(fmt.Sprintf("rebalanced_%d", i))
+		plantReplica(t, fs, key, []byte(key), 1)
+		keys = append(keys, key)
+	}
+
+	go fs.Start()
+	defer fs.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	joined := makeNewServer(":3025", ":3024")
+	joined.ReplicationFactor = 1
+	defer teardown(t, joined.storage)
+	go joined.Start()
+	defer joined.Stop()
+	waitForPeers(t, fs, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		moved, misplaced := 0, 0
+		for _, key := range keys {
+			owner := fs.replicaOwners(key)[0]
+			switch {
+			case owner == joined.ID && joined.storage.Present(joined.ID, key):
+				moved++
+				if fs.storage.Present(fs.ID, key) {
+					misplaced++
+				}
+			case owner == joined.ID:
+				misplaced++
+			case !fs.storage.Present(fs.ID, key):
+				t.Fatalf("(%s) got lost", key)
+			}
+		}
+
+		if moved > 0 && misplaced == 0 && !fs.RebalanceProgress().Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted every replica on its owner, %d moved, %d misplaced, progress %+v", moved, misplaced, fs.RebalanceProgress())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if progress := fs.RebalanceProgress(); progress.FilesDone != progress.Files || progress.Failures != 0 {
+		t.Errorf("wanted every transfer done, got %+v", progress)
+	}
+}
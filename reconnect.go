@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// defining the delays between attempts to reach a node of the NodeList
+	defaultReconnectBackoff    = 500 * time.Millisecond
+	defaultMaxReconnectBackoff = 30 * time.Second
+
+	// defining how long a dialed node may take to complete the handshake
+	connectTimeout = 10 * time.Second
+)
+
+// backoff hands out exponentially growing delays between retries.
+// Every delay is jittered, so nodes which lost a peer at the same time
+// don't all dial it again at the same moment.
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+// Next returns a delay between half of and the full current step
+// and doubles the step up to max
+func (b *backoff) Next() time.Duration {
+	step := b.min << b.attempt
+	if step <= 0 || step >= b.max {
+		step = b.max
+	} else {
+		b.attempt++
+	}
+
+	return step/2 + rand.N(step/2+1)
+}
+
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
+
+// connectNodes keeps a connection to every node of the NodeList until Stop
+func (fs *FileServer) connectNodes() {
+	for _, addr := range fs.NodeList {
+		if len(addr) == 0 {
+			continue
+		}
+		go fs.keepConnected(addr)
+	}
+}
+
+// keepConnected dials addr whenever no peer listening on it is connected
+// and waits longer after every failed attempt
+func (fs *FileServer) keepConnected(addr string) {
+	events := fs.watchConnection(addr)
+	retry := backoff{min: fs.ReconnectBackoff, max: fs.MaxReconnectBackoff}
+
+	for {
+		if fs.connectedTo(addr) {
+			retry.Reset()
+			select {
+			case <-events:
+				continue
+			case <-fs.quitChannel:
+				return
+			}
+		}
+
+		// a node dialed for a call already is kept once it is connected,
+		// so two connections to it are never told apart
+		dialing := fs.startDial(addr)
+		var err error
+		if dialing {
+			log.Printf("[%s] Attempting to connect %s\n", fs.Transport.Addr(), addr)
+			err = fs.Transport.Dial(addr)
+		}
+		if err != nil {
+			fs.endDial(addr)
+			log.Println("Dial Error ", err)
+		} else {
+			// the peer is registered once the handshake completes
+			select {
+			case <-events:
+			case <-time.After(connectTimeout):
+			case <-fs.quitChannel:
+				return
+			}
+			if dialing {
+				fs.endDial(addr)
+			}
+			if fs.connectedTo(addr) {
+				// the nodes of the NodeList are where this node joins the DHT
+				go fs.dht.Bootstrap(fs.ctx)
+				continue
+			}
+		}
+
+		delay := retry.Next()
+		log.Printf("[%s] Retrying %s in %s", fs.Transport.Addr(), addr, delay)
+		select {
+		case <-time.After(delay):
+		case <-fs.quitChannel:
+			return
+		}
+	}
+}
+
+// connectedTo reports whether a peer listening on addr is connected.
+// A node of the NodeList is always a peer, even if it was dialed for calls only.
+func (fs *FileServer) connectedTo(addr string) bool {
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
+
+	for _, peer := range fs.peers {
+		if peer.Info().ListenAddr == addr {
+			fs.use(peer, false)
+			return true
+		}
+	}
+	return false
+}
+
+// startDial claims addr for dialing and reports whether
+// no one else is dialing it already
+func (fs *FileServer) startDial(addr string) bool {
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
+
+	if fs.dialing[addr] {
+		return false
+	}
+	fs.dialing[addr] = true
+	return true
+}
+
+// endDial releases addr claimed by startDial
+func (fs *FileServer) endDial(addr string) {
+	fs.lockPeer.Lock()
+	delete(fs.dialing, addr)
+	fs.lockPeer.Unlock()
+}
+
+// watchConnection returns the channel which is signalled
+// whenever a peer listening on addr connects or disconnects
+func (fs *FileServer) watchConnection(addr string) <-chan struct{} {
+	fs.lockPeer.Lock()
+	defer fs.lockPeer.Unlock()
+
+	events, ok := fs.connectionEvents[addr]
+	if !ok {
+		events = make(chan struct{}, 1)
+		fs.connectionEvents[addr] = events
+	}
+	return events
+}
+
+// notifyConnection signals the watcher of addr without blocking.
+// The caller must hold lockPeer.
+func (fs *FileServer) notifyConnection(addr string) {
+	events, ok := fs.connectionEvents[addr]
+	if !ok {
+		return
+	}
+
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	retry := backoff{min: 100 * time.Millisecond, max: time.Second}
+
+	steps := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, step := range steps {
+		step *= time.Millisecond
+
+		delay := retry.Next()
+		if delay < step/2 || delay > step {
+			t.Errorf("attempt %d: wanted a delay between %s and %s, got %s", i, step/2, step, delay)
+		}
+	}
+
+	retry.Reset()
+	if delay := retry.Next(); delay > 100*time.Millisecond {
+		t.Errorf("wanted the first step after reset, got %s", delay)
+	}
+}
+
+// waitForPeers waits until fs has n peers connected
+func waitForPeers(t testing.TB, fs *FileServer, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fs.lockPeer.Lock()
+		got := len(fs.peers)
+		fs.lockPeer.Unlock()
+
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted %d peers, got %d", n, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	remote := makeNewServer(":3004", "")
+	defer teardown(t, remote.storage)
+	go remote.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	local := makeNewServer(":3005", ":3004")
+	local.ReconnectBackoff = 10 * time.Millisecond
+	defer teardown(t, local.storage)
+	go local.Start()
+	defer local.Stop()
+
+	waitForPeers(t, local, 1)
+
+	// the remote goes away and comes back as a new node on the same address
+	remote.Transport.Close()
+	remote.Stop()
+	remote.lockPeer.Lock()
+	for _, peer := range remote.peers {
+		peer.Close()
+	}
+	remote.lockPeer.Unlock()
+
+	waitForPeers(t, local, 0)
+
+	restarted := makeNewServer(":3004", "")
+	go restarted.Start()
+	defer restarted.Stop()
+
+	waitForPeers(t, local, 1)
+	if _, ok := local.peer(restarted.ID); !ok {
+		t.Errorf("expected to be reconnected to %s", restarted.ID)
+	}
+}
@@ -1,19 +1,48 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log"
-	"os"
+	"path"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
 )
 
-// defining the default root folder
-const defaultRootFolder = "networkStorage"
+const (
+	// defining the default root folder
+	defaultRootFolder = "networkStorage"
+
+	// defining the suffix of the file next to a stored file holding its record
+	recordSuffix = ".record"
+
+	// defining the suffix of the folder next to the files of a node holding its hints
+	hintsSuffix = ".hints"
+
+	// defining the suffix of the files next to a record holding the data of a file,
+	// every version is written to one of its own which its record names once committed
+	dataSuffix = ".data"
+
+	// defining the length of the random tag telling the versions of a file apart
+	blobTagLength = 16
+)
+
+// ErrCorrupted is returned when what is read of a file
+// does not match the checksum recorded for it
+var ErrCorrupted = errors.New("checksum mismatch")
 
 func CASPathTransformFunc(key string) PathKey {
 	hash := sha1.Sum([]byte(key))
@@ -63,10 +92,17 @@ type StorageConfig struct {
 	//Root is folder name of the root containing the files and folder on the disk
 	Root               string
 	PathTransformation PathTransformFunc
+
+	// Backend keeps the files, the disk under Root if nil
+	Backend Backend
 }
 
 type Storage struct {
 	StorageConfig
+
+	// lockRecords serialises the changes to the records,
+	// which decide what the data of a file is
+	lockRecords sync.Mutex
 }
 
 func NewStorage(config StorageConfig) *Storage {
@@ -80,102 +116,662 @@ func NewStorage(config StorageConfig) *Storage {
 		config.Root = defaultRootFolder
 	}
 
+	if config.Backend == nil {
+		config.Backend = NewFileBackend(config.Root)
+	}
+
 	return &Storage{
 		StorageConfig: config,
 	}
 }
 
-func (s *Storage) Present(id string, key string) bool {
-	pk := s.PathTransformation(key)
-	fullpath := fmt.Sprintf("%s/%s/%s", s.Root, id, pk.CompletePath())
+// partialCleaner is a Backend whose interrupted writes leave files behind
+type partialCleaner interface {
+	CleanPartial() error
+}
+
+// CleanPartial removes what the writes a crash interrupted left in the backend,
+// the partial files and the data no record names
+func (s *Storage) CleanPartial() error {
+	if c, ok := s.Backend.(partialCleaner); ok {
+		if err := c.CleanPartial(); err != nil {
+			return err
+		}
+	}
 
-	_, err := os.Stat(fullpath)
+	names, err := s.Backend.List("")
 	if err != nil {
-		if os.IsNotExist(err) {
-			return false
-		} else {
-			fmt.Printf("Error in statting the file: %s", err)
+		return err
+	}
+
+	var (
+		named = make(map[string]bool)
+		data  []string
+	)
+	for _, name := range names {
+		switch {
+		case strings.HasSuffix(name, recordSuffix):
+			stored, err := s.readStored(name)
+			if err != nil {
+				return err
+			}
+			named[stored.Data] = true
+		case isBlob(name):
+			data = append(data, name)
+		}
+	}
+
+	for _, name := range data {
+		if named[name] {
+			continue
+		}
+		log.Printf("removing uncommitted data %s", name)
+		if err := s.Backend.Delete(name); err != nil {
+			return err
 		}
 	}
 
-	return true
+	return nil
+}
+
+// name is where the file of key stored for id is kept in the backend
+func (s *Storage) name(id string, key string) string {
+	pk := s.PathTransformation(key)
+	return fmt.Sprintf("%s/%s", id, pk.CompletePath())
+}
+
+func (s *Storage) Present(id string, key string) bool {
+	return s.PresentContext(context.Background(), id, key)
+}
+
+func (s *Storage) PresentContext(ctx context.Context, id string, key string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	err := s.withData(id, key, func(_ Record, data string) error {
+		if !s.Backend.Has(data) {
+			return fs.ErrNotExist
+		}
+		return nil
+	})
+	return err == nil
 }
 
 // Clearing the entire storage along with the root folder
 func (s *Storage) Clear() error {
-	return os.RemoveAll(s.Root)
+	return s.ClearContext(context.Background())
+}
+
+func (s *Storage) ClearContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Backend.Delete("")
 }
 
-// This delete function for now is not taking in account
-// the probabibility of partial hash collision
 func (s *Storage) Delete(id string, key string) error {
+	return s.DeleteContext(context.Background(), id, key)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, id string, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	pk := s.PathTransformation(key)
 
 	defer func() {
 		log.Printf("deleted [%s] from disk", pk.Filename)
 	}()
 
-	completePath := fmt.Sprintf("%s/%s/%s", s.Root, id, pk.PathRoot)
-	if err := os.RemoveAll(completePath); err != nil {
+	s.lockRecords.Lock()
+	defer s.lockRecords.Unlock()
+
+	// the file is gone once its record is
+	name := s.name(id, key)
+	stored, err := s.readStored(name + recordSuffix)
+	if err != nil {
+		return err
+	}
+	if err := s.Backend.Delete(name + recordSuffix); err != nil {
 		return err
 	}
 
-	return nil
+	return s.deleteData(name, stored)
+}
+
+// deleteData removes the data the record stored under name named
+func (s *Storage) deleteData(name string, stored storedRecord) error {
+	if len(stored.Data) > 0 {
+		return s.Backend.Delete(stored.Data)
+	}
+	return s.Backend.Delete(name)
 }
 
+// Write stores what is read from r as a file without metadata,
+// replacing the file stored under key and its record
 func (s *Storage) Write(id string, key string, r io.Reader) (int64, error) {
-	return s.writeStream(id, key, r)
+	return s.WriteContext(context.Background(), id, key, r)
 }
 
-func (s *Storage) WriteDecrypt(id string, encKey []byte, key string, r io.Reader) (int64, error) {
-	f, err := s.openFile(id, key)
+// WriteContext is Write which stops copying once the ctx is done
+func (s *Storage) WriteContext(ctx context.Context, id string, key string, r io.Reader) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.writeStream(id, key, newContextReader(ctx, r))
+}
+
+func (s *Storage) writeStream(id string, key string, r io.Reader) (int64, error) {
+	blob, err := s.writeBlob(id, key, r)
 	if err != nil {
 		return 0, err
 	}
 
-	n, err := enc.StreamDecrypt(encKey, r, f)
-	return int64(n), err
+	return blob.Size, s.Commit(blob, func(Record) (Record, error) {
+		return Record{Key: key}, nil
+	})
 }
 
-func (s *Storage) openFile(id string, key string) (*os.File, error) {
-	pathKey := s.PathTransformation(key)
-	pathName := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
+// Blob is the data of a version of a file written by WriteBlob,
+// which is not read as the data of the file before Commit
+type Blob struct {
+	id   string
+	key  string
+	name string
+
+	Size int64
+}
 
-	if err := os.MkdirAll(pathName, os.ModePerm); err != nil {
+// WriteBlob writes what is read from r next to the file stored under key
+// and stops once the ctx is done. Nothing is kept if it fails.
+func (s *Storage) WriteBlob(ctx context.Context, id string, key string, r io.Reader) (*Blob, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
+	return s.writeBlob(id, key, newContextReader(ctx, r))
+}
+
+func (s *Storage) writeBlob(id string, key string, r io.Reader) (*Blob, error) {
+	blob := &Blob{
+		id:   id,
+		key:  key,
+		name: fmt.Sprintf("%s.%s%s", s.name(id, key), enc.GenerateID()[:blobTagLength], dataSuffix),
+	}
 
-	completePath := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.CompletePath())
-	return os.Create(completePath)
+	n, err := s.Backend.Put(blob.name, r)
+	if err != nil {
+		return nil, err
+	}
+	blob.Size = n
 
+	return blob, nil
 }
-func (s *Storage) writeStream(id string, key string, r io.Reader) (int64, error) {
 
-	f, err := s.openFile(id, key)
+// isBlob reports whether name is one writeBlob chose,
+// rather than the name of a file stored before blobs were
+func isBlob(name string) bool {
+	rest, ok := strings.CutSuffix(name, dataSuffix)
+	i := strings.LastIndex(rest, ".")
+	if !ok || i < 0 {
+		return false
+	}
+
+	tag := rest[i+1:]
+	_, err := hex.DecodeString(tag)
+	return len(tag) == blobTagLength && err == nil
+}
+
+// Commit makes the blob the data of its file, kept under the record
+// commit returns given the record of the file so far, the zero Record if there is none.
+// The record is written at once, a reader sees either the file as it was or the blob.
+// If commit fails, the blob is discarded and the file is left as it was.
+func (s *Storage) Commit(blob *Blob, commit func(existing Record) (Record, error)) error {
+	s.lockRecords.Lock()
+	defer s.lockRecords.Unlock()
+
+	name := s.name(blob.id, blob.key)
+	existing, err := s.readStored(name + recordSuffix)
+	if err == nil {
+		var record Record
+		record, err = commit(existing.Record)
+		if err == nil {
+			err = s.writeStored(name, storedRecord{Record: record, Data: blob.name})
+		}
+	}
 	if err != nil {
-		return 0, err
+		s.Discard(blob)
+		return err
 	}
 
-	return io.Copy(f, r)
+	// the data of the version replaced is no longer read
+	return s.deleteData(name, existing)
 }
 
-func (s *Storage) Read(id string, key string) (int64, io.Reader, error) {
-	return s.readStream(id, key)
+// Discard removes a blob which is not committed
+func (s *Storage) Discard(blob *Blob) error {
+	return s.Backend.Delete(blob.name)
 }
 
-func (s *Storage) readStream(id string, key string) (int64, io.ReadCloser, error) {
-	pk := s.PathTransformation(key)
-	completePath := fmt.Sprintf("%s/%s/%s", s.Root, id, pk.CompletePath())
+// Record describes a stored file and is kept next to it
+type Record struct {
+	Key     string
+	Version int64
+
+	// Checksum is the SHA-256 of a replica as the peer which stored it sent it,
+	// empty for a file written by this node
+	Checksum string
+
+	// Deleted marks the tombstone of a file deleted at Version. Nothing is kept
+	// for it but the record, which keeps older versions from being written again.
+	Deleted bool
+
+	Metadata
+}
+
+// stored is the checksum of the bytes kept for the record,
+// a replica is kept encrypted and a file written by this node is not
+func (r Record) stored() string {
+	if len(r.Checksum) > 0 {
+		return r.Checksum
+	}
+	return r.SHA256
+}
+
+// replicaKey is the key the replicas of the file are stored under,
+// the hash of the key of a file written by this node
+func (r Record) replicaKey() string {
+	if len(r.Checksum) > 0 || r.Deleted {
+		return r.Key
+	}
+	return enc.HashKey(r.Key)
+}
+
+// Metadata describes a file as it was stored by Store
+// and travels along with every replica of it
+type Metadata struct {
+	// Name is the key the file was stored under, the Key of a replica is its hash
+	Name string
+
+	// Size is the number of bytes of the file before it is encrypted,
+	// SHA256 their hex SHA-256, empty if it is unknown
+	Size        int64
+	SHA256      string
+	ContentType string
+
+	// Created is when the first version of the file known to the node
+	// was stored, Modified when this version was
+	Created  time.Time
+	Modified time.Time
+}
+
+// storedRecord is a Record as it is kept next to the file,
+// naming the blob holding its data. The data of a file
+// stored before blobs were is kept under the name of the file.
+type storedRecord struct {
+	Record
+	Data string `json:",omitempty"`
+}
+
+// data returns the name the data of the file stored under name is kept under
+func (sr storedRecord) data(name string) string {
+	if len(sr.Data) > 0 {
+		return sr.Data
+	}
+	return name
+}
+
+// WriteRecord replaces the record of a stored file, which keeps its data
+func (s *Storage) WriteRecord(id string, record Record) error {
+	s.lockRecords.Lock()
+	defer s.lockRecords.Unlock()
+
+	name := s.name(id, record.Key)
+	stored, err := s.readStored(name + recordSuffix)
+	if err != nil {
+		return err
+	}
+
+	stored.Record = record
+	return s.writeStored(name, stored)
+}
+
+// Tombstone replaces the file stored under record.Key by its record marked Deleted
+func (s *Storage) Tombstone(id string, record Record) error {
+	s.lockRecords.Lock()
+	defer s.lockRecords.Unlock()
+
+	name := s.name(id, record.Key)
+	stored, err := s.readStored(name + recordSuffix)
+	if err != nil {
+		return err
+	}
+
+	record.Deleted = true
+	if err := s.writeStored(name, storedRecord{Record: record}); err != nil {
+		return err
+	}
+	return s.deleteData(name, stored)
+}
+
+func (s *Storage) writeStored(name string, stored storedRecord) error {
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Backend.Put(name+recordSuffix, bytes.NewReader(b))
+	return err
+}
 
-	file, err := os.Open(completePath)
+// Record returns the record of a stored file, the zero Record if there is none
+func (s *Storage) Record(id string, key string) (Record, error) {
+	return s.readRecord(s.name(id, key) + recordSuffix)
+}
+
+func (s *Storage) readRecord(name string) (Record, error) {
+	stored, err := s.readStored(name)
+	return stored.Record, err
+}
+
+func (s *Storage) readStored(name string) (storedRecord, error) {
+	var stored storedRecord
+
+	b, err := s.readAll(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return stored, nil
+	}
+	if err != nil {
+		return stored, err
+	}
+
+	err = json.Unmarshal(b, &stored)
+	return stored, err
+}
+
+// withData calls fn with the record of a stored file and the name of its data,
+// again if fn did not find the data because a newer version replaced it meanwhile
+func (s *Storage) withData(id string, key string, fn func(record Record, data string) error) error {
+	name := s.name(id, key)
+	for {
+		stored, err := s.readStored(name + recordSuffix)
+		if err != nil {
+			return err
+		}
+
+		err = fn(stored.Record, stored.data(name))
+		if errors.Is(err, fs.ErrNotExist) && len(stored.Data) > 0 {
+			latest, latestErr := s.readStored(name + recordSuffix)
+			if latestErr == nil && len(latest.Data) > 0 && latest.Data != stored.Data {
+				continue
+			}
+		}
+		return err
+	}
+}
+
+func (s *Storage) readAll(name string) ([]byte, error) {
+	_, r, err := s.Backend.Get(name)
 	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// Records returns the records of every file stored for id,
+// tombstones included
+func (s *Storage) Records(id string) ([]Record, error) {
+	names, err := s.Backend.List(id + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, name := range names {
+		if !strings.HasSuffix(name, recordSuffix) {
+			continue
+		}
+
+		record, err := s.readRecord(name)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// Hint names a disconnected owner a replica stored under Key is handed to
+// once it connects again. The hints of a node are kept next to its files.
+type Hint struct {
+	Owner string
+	Key   string
+}
+
+func (s *Storage) hintPath(id string, owner string) string {
+	return fmt.Sprintf("%s%s/%s", id, hintsSuffix, owner)
+}
+
+// WriteHint keeps a hint until DeleteHint
+func (s *Storage) WriteHint(id string, hint Hint) error {
+	b, err := json.Marshal(hint)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Backend.Put(fmt.Sprintf("%s/%s", s.hintPath(id, hint.Owner), hint.Key), bytes.NewReader(b))
+	return err
+}
+
+// Hints returns the hints kept for owner
+func (s *Storage) Hints(id string, owner string) ([]Hint, error) {
+	names, err := s.Backend.List(s.hintPath(id, owner) + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	hints := make([]Hint, 0, len(names))
+	for _, name := range names {
+		b, err := s.readAll(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var hint Hint
+		if err := json.Unmarshal(b, &hint); err != nil {
+			return nil, err
+		}
+		hints = append(hints, hint)
+	}
+
+	return hints, nil
+}
+
+// Hinted reports whether a hint is kept for key for any owner
+func (s *Storage) Hinted(id string, key string) bool {
+	names, _ := s.Backend.List(id + hintsSuffix + "/")
+	return slices.ContainsFunc(names, func(name string) bool {
+		return path.Base(name) == key
+	})
+}
+
+// DeleteHints drops every hint kept for id
+func (s *Storage) DeleteHints(id string) error {
+	return s.Backend.Delete(id + hintsSuffix)
+}
+
+func (s *Storage) DeleteHint(id string, hint Hint) error {
+	return s.Backend.Delete(fmt.Sprintf("%s/%s", s.hintPath(id, hint.Owner), hint.Key))
+}
+
+// Stat returns the record of a stored file, filled in from the backend
+// for a file stored before records carried its metadata
+func (s *Storage) Stat(id string, key string) (Record, error) {
+	var (
+		record Record
+		entry  Entry
+	)
+	err := s.withData(id, key, func(r Record, data string) error {
+		var err error
+		record = r
+		entry, err = s.Backend.Stat(data)
+		return err
+	})
+	if err != nil {
+		return Record{}, err
+	}
+
+	if len(record.Key) == 0 {
+		record.Key = key
+	}
+	if len(record.Name) == 0 && len(record.Checksum) == 0 {
+		record.Name = key
+	}
+	if record.Modified.IsZero() {
+		record.Modified = entry.ModTime
+		record.Size = entry.Size
+		if len(record.Checksum) > 0 {
+			record.Size -= enc.Overhead
+		}
+	}
+
+	return record, nil
+}
+
+// Walk calls fn with the record of every file stored for id which has one,
+// as Stat returns it. Walking stops at the first error of fn,
+// which Walk returns unless it is fs.SkipAll.
+func (s *Storage) Walk(id string, fn func(Record) error) error {
+	names, err := s.Backend.List(id + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if !strings.HasSuffix(name, recordSuffix) {
+			continue
+		}
+
+		record, err := s.readRecord(name)
+		if err != nil {
+			return err
+		}
+
+		// the record may outlive its file while the file is deleted
+		record, err = s.Stat(id, record.Key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = fn(record)
+		}
+		if errors.Is(err, fs.SkipAll) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List returns the records of the files stored for id
+// whose name starts with prefix, sorted by name
+func (s *Storage) List(id string, prefix string) ([]Record, error) {
+	var records []Record
+	err := s.Walk(id, func(record Record) error {
+		if strings.HasPrefix(record.Name, prefix) {
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(records, func(a, b Record) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return records, nil
+}
+
+// Version returns the version recorded for a stored file, 0 if there is none
+func (s *Storage) Version(id string, key string) (int64, error) {
+	record, err := s.Record(id, key)
+	return record.Version, err
+}
+
+// Read returns the size of a stored file and a reader of it
+// which fails with ErrCorrupted at the end of a file not matching its record
+func (s *Storage) Read(id string, key string) (int64, io.Reader, error) {
+	return s.readStream(id, key)
+}
+
+// ReadContext is Read whose returned reader fails once the ctx is done
+func (s *Storage) ReadContext(ctx context.Context, id string, key string) (int64, io.Reader, error) {
+	if err := ctx.Err(); err != nil {
 		return 0, nil, err
 	}
 
-	fi, err := file.Stat()
+	size, r, err := s.readStream(id, key)
 	if err != nil {
 		return 0, nil, err
 	}
 
-	return fi.Size(), file, nil
+	return size, newContextReader(ctx, r), nil
+}
+
+func (s *Storage) readStream(id string, key string) (int64, io.ReadCloser, error) {
+	var (
+		record Record
+		size   int64
+		r      io.ReadCloser
+	)
+	err := s.withData(id, key, func(rec Record, data string) error {
+		var err error
+		record = rec
+		size, r, err = s.Backend.Get(data)
+		return err
+	})
+	if err != nil || len(record.stored()) == 0 {
+		return size, r, err
+	}
+
+	return size, &verifyingReader{
+		ReadCloser: r,
+		key:        key,
+		hash:       sha256.New(),
+		want:       record.stored(),
+	}, nil
+}
+
+// verifyingReader hashes a stored file while it is read
+// and fails with ErrCorrupted at its end if the hash does not match its record
+type verifyingReader struct {
+	io.ReadCloser
+	key  string
+	hash hash.Hash
+	want string
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.ReadCloser.Read(p)
+	vr.hash.Write(p[:n])
+
+	if err == io.EOF {
+		got := hex.EncodeToString(vr.hash.Sum(nil))
+		if got != vr.want {
+			return n, fmt.Errorf("(%s) read with checksum %s, recorded %s: %w", vr.key, got, vr.want, ErrCorrupted)
+		}
+	}
+
+	return n, err
 }
@@ -2,9 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"slices"
 	"testing"
+	"time"
 
 	enc "github.com/palSagnik/Distributed-File-Storage/Encoding"
 )
@@ -65,8 +72,331 @@ func TestStorageCRD(t *testing.T) {
 	}
 }
 
-func teardown(t *testing.T, s *Storage) {
+// rot replaces the data of a stored file behind the back of its record
+func rot(t *testing.T, s *Storage, id string, key string, data []byte) {
+	t.Helper()
+
+	name := s.name(id, key)
+	stored, err := s.readStored(name + recordSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Backend.Put(stored.data(name), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func teardown(t testing.TB, s *Storage) {
 	if err := s.Clear(); err != nil {
 		t.Error(err)
 	}
-}
\ No newline at end of file
+}
+func TestStorageWriteCancelled(t *testing.T) {
+	s := NewStorage(StorageConfig{
+		PathTransformation: CASPathTransformFunc,
+	})
+	id := enc.GenerateID()
+	defer teardown(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := s.WriteContext(ctx, id, "fooandbar", bytes.NewReader([]byte("never written"))); !errors.Is(err, context.Canceled) {
+		t.Errorf("wanted %s, got %v", context.Canceled, err)
+	}
+
+	if s.Present(id, "fooandbar") {
+		t.Errorf("expected no file to be written after cancel")
+	}
+}
+
+func TestStorageVersion(t *testing.T) {
+	s := NewStorage(StorageConfig{
+		PathTransformation: CASPathTransformFunc,
+	})
+	id := enc.GenerateID()
+	defer teardown(t, s)
+
+	key := "versioned"
+	if _, err := s.Write(id, key, bytes.NewReader([]byte("v1"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if version, err := s.Version(id, key); err != nil || version != 0 {
+		t.Errorf("wanted version 0 before one is written, got %d (%v)", version, err)
+	}
+
+	if err := s.WriteRecord(id, Record{Key: key, Version: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := s.Version(id, key); err != nil || version != 42 {
+		t.Errorf("wanted version 42, got %d (%v)", version, err)
+	}
+
+	if err := s.Delete(id, key); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := s.Version(id, key); err != nil || version != 0 {
+		t.Errorf("wanted the version deleted with the file, got %d (%v)", version, err)
+	}
+}
+
+func TestStorageHints(t *testing.T) {
+	s := NewStorage(StorageConfig{
+		PathTransformation: CASPathTransformFunc,
+	})
+	id := enc.GenerateID()
+	defer teardown(t, s)
+
+	owner := enc.GenerateID()
+	key := enc.HashKey("hinted")
+	if hints, err := s.Hints(id, owner); err != nil || len(hints) != 0 {
+		t.Errorf("wanted no hints before one is written, got %v (%v)", hints, err)
+	}
+
+	hint := Hint{Owner: owner, Key: key}
+	if err := s.WriteHint(id, hint); err != nil {
+		t.Fatal(err)
+	}
+	if hints, err := s.Hints(id, owner); err != nil || len(hints) != 1 || hints[0] != hint {
+		t.Errorf("wanted %v, got %v (%v)", hint, hints, err)
+	}
+	if !s.Hinted(id, key) {
+		t.Errorf("wanted (%s) hinted", key)
+	}
+
+	// the hints are not mistaken for stored files
+	if records, err := s.Records(id); err != nil || len(records) != 0 {
+		t.Errorf("wanted no records, got %v (%v)", records, err)
+	}
+
+	if err := s.DeleteHint(id, hint); err != nil {
+		t.Fatal(err)
+	}
+	if s.Hinted(id, key) {
+		t.Errorf("wanted the hint of (%s) deleted", key)
+	}
+}
+
+func TestStorageStat(t *testing.T) {
+	s := NewStorage(StorageConfig{
+		PathTransformation: CASPathTransformFunc,
+		Backend:            NewMemoryBackend(),
+	})
+	id := enc.GenerateID()
+
+	if _, err := s.Stat(id, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("wanted %s, got %v", fs.ErrNotExist, err)
+	}
+
+	// a file without metadata is described by the backend
+	key := "plain"
+	if _, err := s.Write(id, key, bytes.NewReader([]byte("12345"))); err != nil {
+		t.Fatal(err)
+	}
+	record, err := s.Stat(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Key != key || record.Name != key || record.Size != 5 || record.Modified.IsZero() {
+		t.Errorf("wanted (%s) of 5 bytes, got %+v", key, record)
+	}
+
+	metadata := Metadata{Name: key, Size: 5, ContentType: "text/plain", Created: time.Unix(1, 0), Modified: time.Unix(2, 0)}
+	if err := s.WriteRecord(id, Record{Key: key, Version: 2, Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+	record, err = s.Stat(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Version != 2 || record.Name != metadata.Name || record.ContentType != metadata.ContentType ||
+		!record.Created.Equal(metadata.Created) || !record.Modified.Equal(metadata.Modified) {
+		t.Errorf("wanted %+v, got %+v", metadata, record.Metadata)
+	}
+}
+
+func TestStorageList(t *testing.T) {
+	s := NewStorage(StorageConfig{
+		PathTransformation: CASPathTransformFunc,
+		Backend:            NewMemoryBackend(),
+	})
+	id := enc.GenerateID()
+
+	for _, name := range []string{"b/1", "a/2", "a/1"} {
+		if _, err := s.Write(id, name, bytes.NewReader([]byte(name))); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteRecord(id, Record{Key: name, Version: 1, Metadata: Metadata{Name: name, Size: 3}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a replica is listed by the name it was stored under
+	if _, err := s.Write(id, enc.HashKey("a/3"), bytes.NewReader([]byte("replica"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteRecord(id, Record{Key: enc.HashKey("a/3"), Version: 1, Checksum: "sum", Metadata: Metadata{Name: "a/3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := s.List(id, "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, record := range records {
+		names = append(names, record.Name)
+	}
+	if want := []string{"a/1", "a/2", "a/3"}; !slices.Equal(names, want) {
+		t.Errorf("wanted %v, got %v", want, names)
+	}
+
+	walked := 0
+	err = s.Walk(id, func(record Record) error {
+		walked++
+		return fs.SkipAll
+	})
+	if err != nil || walked != 1 {
+		t.Errorf("wanted the walk stopped after 1 file, got %d (%v)", walked, err)
+	}
+}
+
+func TestStorageCorrupted(t *testing.T) {
+	s := NewStorage(StorageConfig{
+		PathTransformation: CASPathTransformFunc,
+		Backend:            NewMemoryBackend(),
+	})
+	id := enc.GenerateID()
+
+	key := "verified"
+	data := []byte("read back as written")
+	sum := sha256.Sum256(data)
+	if _, err := s.Write(id, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteRecord(id, Record{Key: key, Version: 1, Metadata: Metadata{Name: key, SHA256: hex.EncodeToString(sum[:])}}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("wanted %s, got %s (%v)", data, b, err)
+	}
+
+	// a bit flipped on the disk
+	rotten := bytes.Clone(data)
+	rotten[0] ^= 1
+	rot(t, s, id, key, rotten)
+
+	_, r, err = s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("wanted %s, got %v", ErrCorrupted, err)
+	}
+}
+
+func TestStorageCommit(t *testing.T) {
+	s := NewStorage(StorageConfig{
+		PathTransformation: CASPathTransformFunc,
+		Backend:            NewMemoryBackend(),
+	})
+	id := enc.GenerateID()
+
+	key := "committed"
+	commit := func(data string, version int64) error {
+		sum := sha256.Sum256([]byte(data))
+		blob, err := s.WriteBlob(context.Background(), id, key, bytes.NewReader([]byte(data)))
+		if err != nil {
+			return err
+		}
+		return s.Commit(blob, func(existing Record) (Record, error) {
+			if version < existing.Version {
+				return existing, ErrOutdated
+			}
+			return Record{Key: key, Version: version, Metadata: Metadata{Name: key, SHA256: hex.EncodeToString(sum[:])}}, nil
+		})
+	}
+	read := func(r io.Reader) string {
+		t.Helper()
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if err := commit("first", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// a blob is not read before it is committed
+	blob, err := s.WriteBlob(context.Background(), id, key, bytes.NewReader([]byte("pending")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(r); got != "first" {
+		t.Errorf("wanted first before the commit, got %s", got)
+	}
+
+	// what a crash left uncommitted is cleaned up,
+	// a file stored before blobs were is not mistaken for one
+	legacy := id + "/stored/before.data"
+	if _, err := s.Backend.Put(legacy, bytes.NewReader([]byte("old"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CleanPartial(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Backend.Has(blob.name) {
+		t.Errorf("wanted the uncommitted blob removed")
+	}
+	if !s.Backend.Has(legacy) {
+		t.Errorf("wanted %s kept", legacy)
+	}
+	if err := s.Backend.Delete(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader of the replaced version reads it to its end
+	_, r, err = s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commit("second", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(r); got != "first" {
+		t.Errorf("wanted first read while it was replaced, got %s", got)
+	}
+
+	// a refused commit leaves the file as it was
+	if err := commit("outdated", 1); !errors.Is(err, ErrOutdated) {
+		t.Errorf("wanted %s, got %v", ErrOutdated, err)
+	}
+	_, r, err = s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(r); got != "second" {
+		t.Errorf("wanted second, got %s", got)
+	}
+
+	// only the data of the current version is kept
+	names, err := s.Backend.List(id + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Errorf("wanted the record and the data of the file, got %v", names)
+	}
+}